@@ -2,19 +2,20 @@ package silicon
 
 import (
 	"fmt"
-	"math"
+	"sync"
 	"time"
 )
 
 /*
-  A concurrent metric cache. It should be fast to store metrics and should not block.
-
+	A concurrent metric cache. It should be fast to store metrics and should not block.
 */
 type MetricCache interface {
-	Store(*Metric)                 // non-blocking, eventually delivered
+	Store(*Metric)                 // non-blocking unless full with the Block policy, eventually delivered
 	Size() int                     // the total number of data points on all keys
 	Pop(string) []DataPoint        // remove and return all data points for a given key
+	Get(string) []DataPoint        // return a copy of all data points for a given key without removing them
 	Counts() map[string]int        // return a map of keys and their counts
+	Notify() <-chan bool           // receives when data is ready to flush, closed when the cache is closed
 	Close() map[string][]DataPoint // close down this metric cache
 }
 
@@ -22,12 +23,171 @@ type metricCache struct {
 	data     map[string][]DataPoint
 	count    int
 	commands chan commandData
+
+	budget    *cacheBudget
+	freed     <-chan bool // signalled when another cache sharing the budget gives space back
+	policy    OverflowPolicy
+	blocked   []commandData // stores waiting for space under the Block policy
+	dropped   map[OverflowPolicy]int
+	onDropped func(string, int)
+
+	ready       chan bool
+	flushPoints int
+	flushAge    time.Duration
+	ageTimer    <-chan time.Time
+	since       map[string]time.Time // when each key's first unflushed point was stored
+}
+
+/*
+	What a bounded cache does with a new point once it is full.
+*/
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota // discard the incoming point
+	DropOldest                       // discard the oldest point on the incoming point's key
+	Block                            // block the caller of Store until space is freed
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(policy))
+}
+
+/*
+	Look up an overflow policy by name; drop-newest, drop-oldest or block.
+*/
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest, Block} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid overflow policy '%v'", name)
+}
+
+// approximate memory used by a data point and by each key in the cache
+const (
+	dataPointBytes = 16
+	cacheKeyBytes  = 48
+)
+
+/*
+	The points and bytes held against a cache's limits. The shards of a
+	sharded cache share one budget so that the limits hold across all of
+	them, each shard takes space before storing and gives it back on pop.
+*/
+type cacheBudget struct {
+	maxPoints int
+	maxBytes  int
+
+	mutex   sync.Mutex
+	points  int
+	bytes   int
+	waiting []chan bool
+}
+
+func newCacheBudget(maxPoints, maxBytes int) *cacheBudget {
+	return &cacheBudget{maxPoints: maxPoints, maxBytes: maxBytes}
+}
+
+func (budget *cacheBudget) unlimited() bool {
+	return budget.maxPoints <= 0 && budget.maxBytes <= 0
+}
+
+/*
+	Take space for points and bytes if it fits within the limits, otherwise
+	take nothing and return false.
+*/
+func (budget *cacheBudget) take(points, bytes int) bool {
+	if budget.unlimited() {
+		return true
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	if budget.maxPoints > 0 && budget.points+points > budget.maxPoints {
+		return false
+	}
+	if budget.maxBytes > 0 && budget.bytes+bytes > budget.maxBytes {
+		return false
+	}
+	budget.points += points
+	budget.bytes += bytes
+	return true
+}
+
+/*
+	Give back space and wake every cache sharing the budget so that any
+	blocked stores can retry.
+*/
+func (budget *cacheBudget) give(points, bytes int) {
+	if budget.unlimited() || (points == 0 && bytes == 0) {
+		return
+	}
+	budget.mutex.Lock()
+	budget.points -= points
+	budget.bytes -= bytes
+	waiting := budget.waiting
+	budget.mutex.Unlock()
+	for _, freed := range waiting {
+		select {
+		case freed <- true:
+		default:
+		}
+	}
+}
+
+/*
+	Return a channel signalled whenever space is given back.
+*/
+func (budget *cacheBudget) watch() <-chan bool {
+	freed := make(chan bool, 1)
+	budget.mutex.Lock()
+	budget.waiting = append(budget.waiting, freed)
+	budget.mutex.Unlock()
+	return freed
+}
+
+/*
+	The bytes a key and its points hold against the limit.
+*/
+func cachedBytes(key string, points int) int {
+	return cacheKeyBytes + len(key) + points*dataPointBytes
 }
 
+/*
+	Create an unbounded metric cache.
+*/
 func NewMetricCache() *metricCache {
+	return NewBoundedMetricCache(0, 0, DropNewest)
+}
+
+/*
+	Create a metric cache holding at most maxPoints data points and roughly
+	maxBytes bytes, a limit of zero is unlimited. When full, new points are
+	handled according to policy.
+*/
+func NewBoundedMetricCache(maxPoints, maxBytes int, policy OverflowPolicy) *metricCache {
+	return newBudgetedMetricCache(newCacheBudget(maxPoints, maxBytes), policy)
+}
+
+func newBudgetedMetricCache(budget *cacheBudget, policy OverflowPolicy) *metricCache {
 	cache := new(metricCache)
 	cache.data = make(map[string][]DataPoint)
 	cache.commands = make(chan commandData, 10)
+	cache.budget = budget
+	cache.freed = budget.watch()
+	cache.policy = policy
+	cache.dropped = make(map[OverflowPolicy]int)
+	cache.ready = make(chan bool, 1)
+	cache.since = make(map[string]time.Time)
 	go cache.run()
 	return cache
 }
@@ -45,12 +205,23 @@ const (
 	store commandAction = iota
 	size
 	pop
+	get
 	counts
+	oldest
+	due
+	dropped
+	thresholds
 	end
 )
 
 func (cache *metricCache) Store(metric *Metric) {
-	cache.commands <- commandData{action: store, value: metric}
+	if cache.policy == Block {
+		result := make(chan interface{})
+		cache.commands <- commandData{action: store, value: metric, result: result}
+		<-result
+	} else {
+		cache.commands <- commandData{action: store, value: metric}
+	}
 }
 
 func (cache *metricCache) Size() int {
@@ -65,12 +236,80 @@ func (cache *metricCache) Pop(key string) []DataPoint {
 	return (<-result).([]DataPoint)
 }
 
+func (cache *metricCache) Get(key string) []DataPoint {
+	result := make(chan interface{})
+	cache.commands <- commandData{action: get, value: key, result: result}
+	return (<-result).([]DataPoint)
+}
+
 func (cache *metricCache) Counts() map[string]int {
 	result := make(chan interface{})
 	cache.commands <- commandData{action: counts, result: result}
 	return (<-result).(map[string]int)
 }
 
+/*
+	Return the oldest timestamp on each key, without copying the points.
+*/
+func (cache *metricCache) Oldest() map[string]int64 {
+	result := make(chan interface{})
+	cache.commands <- commandData{action: oldest, result: result}
+	return (<-result).(map[string]int64)
+}
+
+/*
+	Return the keys that have crossed a flush threshold. Without thresholds
+	every key holding points is due.
+*/
+func (cache *metricCache) Due() map[string]bool {
+	result := make(chan interface{})
+	cache.commands <- commandData{action: due, result: result}
+	return (<-result).(map[string]bool)
+}
+
+/*
+	Return the number of points that were dropped because the cache was
+	full, by the policy in force. For the Block policy this is the number of
+	calls to Store that had to wait.
+*/
+func (cache *metricCache) Dropped() map[OverflowPolicy]int {
+	result := make(chan interface{})
+	cache.commands <- commandData{action: dropped, result: result}
+	return (<-result).(map[OverflowPolicy]int)
+}
+
+/*
+	Register a function to be called with the key and number of points
+	each time points are dropped or evicted, so that anything tracking them
+	can let them go. It is called from the cache's goroutine so it must not
+	call the cache. Must be called before the first Store.
+*/
+func (cache *metricCache) OnDropped(dropped func(string, int)) {
+	cache.onDropped = dropped
+}
+
+func (cache *metricCache) lost(key string, count int) {
+	if cache.onDropped != nil {
+		cache.onDropped(key, count)
+	}
+}
+
+func (cache *metricCache) Notify() <-chan bool {
+	return cache.ready
+}
+
+/*
+	Only signal that data is ready once a key holds maxPoints points or the
+	oldest unflushed point has waited maxAge. By default every Store signals.
+	maxAge bounds the latency of keys that never reach maxPoints so it should
+	always be set along with maxPoints.
+*/
+func (cache *metricCache) SetFlushThresholds(maxPoints int, maxAge time.Duration) {
+	result := make(chan interface{})
+	cache.commands <- commandData{action: thresholds, value: []interface{}{maxPoints, maxAge}, result: result}
+	<-result
+}
+
 func (cache *metricCache) Close() (data map[string][]DataPoint) {
 	result := make(chan interface{})
 	cache.commands <- commandData{action: end, result: result}
@@ -80,54 +319,266 @@ func (cache *metricCache) Close() (data map[string][]DataPoint) {
 }
 
 func (cache *metricCache) run() {
-	for command := range cache.commands {
-		switch command.action {
-		case store:
-			metric := (command.value).(*Metric)
-			cache.data[metric.key] = append(cache.data[metric.key], metric.DataPoint)
-			cache.count++
-		case size:
-			command.result <- cache.count
-		case pop:
-			result, found := cache.data[(command.value).(string)]
-			if found {
-				delete(cache.data, (command.value).(string))
+	for {
+		select {
+		case command := <-cache.commands:
+			if finished := cache.handle(command); finished {
+				return
+			}
+		case <-cache.ageTimer:
+			cache.ageTimer = nil
+			if len(cache.dueKeys()) > 0 {
+				cache.notify()
 			}
+			cache.scheduleAge()
+		case <-cache.freed:
+			cache.unblock()
+		}
+	}
+}
+
+func (cache *metricCache) handle(command commandData) (finished bool) {
+	switch command.action {
+	case store:
+		if len(cache.blocked) > 0 {
+			cache.dropped[Block]++
+			cache.blocked = append(cache.blocked, command)
+		} else {
+			cache.store(command)
+		}
+	case size:
+		command.result <- cache.count
+	case pop:
+		key := (command.value).(string)
+		result, found := cache.data[key]
+		if found {
+			delete(cache.data, key)
+			delete(cache.since, key)
 			cache.count -= len(result)
-			command.result <- result
-		case counts:
-			result := make(map[string]int, len(cache.data))
-			for key, datapoints := range cache.data {
-				result[key] = len(datapoints)
+			cache.budget.give(len(result), cachedBytes(key, len(result)))
+		}
+		command.result <- result
+		cache.unblock()
+	case get:
+		datapoints := cache.data[(command.value).(string)]
+		result := make([]DataPoint, len(datapoints))
+		copy(result, datapoints)
+		command.result <- result
+	case counts:
+		result := make(map[string]int, len(cache.data))
+		for key, datapoints := range cache.data {
+			result[key] = len(datapoints)
+		}
+		command.result <- result
+	case oldest:
+		result := make(map[string]int64, len(cache.data))
+		for key, datapoints := range cache.data {
+			if len(datapoints) > 0 {
+				result[key] = oldestTimestamp(datapoints)
+			}
+		}
+		command.result <- result
+	case due:
+		command.result <- cache.dueKeys()
+	case dropped:
+		result := make(map[OverflowPolicy]int, len(cache.dropped))
+		for policy, count := range cache.dropped {
+			result[policy] = count
+		}
+		command.result <- result
+	case thresholds:
+		values := (command.value).([]interface{})
+		cache.flushPoints = values[0].(int)
+		cache.flushAge = values[1].(time.Duration)
+		cache.ageTimer = nil
+		command.result <- true
+	case end:
+		// release anything still waiting, their points are lost
+		for _, blocked := range cache.blocked {
+			cache.lost((blocked.value).(*Metric).key, 1)
+			blocked.result <- false
+		}
+		close(cache.ready)
+		command.result <- true
+		return true
+	}
+	return false
+}
+
+/*
+	Signal that data is ready without blocking, signals are coalesced.
+*/
+func (cache *metricCache) notify() {
+	select {
+	case cache.ready <- true:
+	default:
+	}
+}
+
+/*
+	The keys holding at least flushPoints points or whose first unflushed
+	point has waited at least flushAge.
+*/
+func (cache *metricCache) dueKeys() map[string]bool {
+	result := make(map[string]bool)
+	now := time.Now()
+	for key, datapoints := range cache.data {
+		switch {
+		case len(datapoints) == 0:
+		case cache.flushPoints == 0 && cache.flushAge == 0:
+			result[key] = true
+		case cache.flushPoints > 0 && len(datapoints) >= cache.flushPoints:
+			result[key] = true
+		case cache.flushAge > 0 && now.Sub(cache.since[key]) >= cache.flushAge:
+			result[key] = true
+		}
+	}
+	return result
+}
+
+/*
+	Wake up when the next key that is not yet due reaches flushAge. Keys
+	already due have been signalled and wait for the bolt.
+*/
+func (cache *metricCache) scheduleAge() {
+	if cache.flushAge == 0 || cache.ageTimer != nil {
+		return
+	}
+	now := time.Now()
+	var next time.Time
+	for _, since := range cache.since {
+		deadline := since.Add(cache.flushAge)
+		if deadline.After(now) && (next.IsZero() || deadline.Before(next)) {
+			next = deadline
+		}
+	}
+	if !next.IsZero() {
+		cache.ageTimer = time.After(next.Sub(now))
+	}
+}
+
+/*
+	Decide whether storing a point on key should signal a flush.
+*/
+func (cache *metricCache) stored(key string) {
+	if cache.flushPoints == 0 && cache.flushAge == 0 {
+		cache.notify()
+		return
+	}
+	if cache.flushPoints > 0 && len(cache.data[key]) == cache.flushPoints {
+		cache.notify()
+	}
+	if cache.flushAge > 0 && cache.ageTimer == nil {
+		cache.ageTimer = time.After(cache.flushAge)
+	}
+}
+
+func (cache *metricCache) store(command commandData) {
+	metric := (command.value).(*Metric)
+	if !cache.budget.take(1, cache.required(metric.key)) {
+		switch cache.policy {
+		case Block:
+			cache.dropped[Block]++
+			cache.blocked = append(cache.blocked, command)
+			return
+		case DropOldest:
+			cache.dropped[DropOldest]++
+			cache.lost(metric.key, 1)
+			points := cache.data[metric.key]
+			// a new key has nothing to drop so the incoming point goes instead
+			if len(points) == 0 {
+				return
+			}
+			// the incoming point takes the evicted point's space
+			cache.data[metric.key] = points[1:]
+			cache.count--
+		default:
+			cache.dropped[cache.policy]++
+			cache.lost(metric.key, 1)
+			if command.result != nil {
+				command.result <- false
 			}
-			command.result <- result
-		case end:
-			command.result <- true
 			return
 		}
 	}
+	cache.add(command)
+}
+
+/*
+	Add a point whose space has already been taken from the budget.
+*/
+func (cache *metricCache) add(command commandData) {
+	metric := (command.value).(*Metric)
+	if _, found := cache.data[metric.key]; !found {
+		cache.since[metric.key] = time.Now()
+	}
+	cache.data[metric.key] = append(cache.data[metric.key], metric.DataPoint)
+	cache.count++
+	cache.stored(metric.key)
+	if command.result != nil {
+		command.result <- true
+	}
+}
+
+/*
+	The bytes storing a point on key adds.
+*/
+func (cache *metricCache) required(key string) int {
+	if _, found := cache.data[key]; found {
+		return dataPointBytes
+	}
+	return cachedBytes(key, 1)
+}
+
+/*
+	Store any blocked points that now fit, in the order they arrived.
+*/
+func (cache *metricCache) unblock() {
+	for len(cache.blocked) > 0 {
+		command := cache.blocked[0]
+		key := (command.value).(*Metric).key
+		if !cache.budget.take(1, cache.required(key)) {
+			return
+		}
+		cache.blocked = cache.blocked[1:]
+		cache.add(command)
+	}
 }
 
 /*
 	A cache bolt allows you to attach a MetricCache to a CacheSink.
-	The bolt continuously polls the cache and pops metrics off in 
-	use order.
+	The bolt waits for the cache to signal that data is ready and then pops
+	metrics off in the order given by its FlushStrategy until no key is due.
+	When the cache reports which keys crossed a flush threshold only those
+	are flushed, the rest stay cached until they cross one. The bolt must be
+	closed before its cache, as it queries the cache while flushing.
 */
 type cacheBolt struct {
-	control chan bool
-	cache   MetricCache
-	sink    CacheSink
+	cache    MetricCache
+	sink     CacheSink
+	strategy FlushStrategy
+	stop     chan bool
+	done     chan bool
 }
 
 type CacheSink interface {
 	Send(string, []DataPoint)
 }
 
-func NewCacheBolt(cache MetricCache, sink CacheSink) *cacheBolt {
+/*
+	Create a cache bolt flushing in the order chosen by strategy, if nil the
+	SortedStrategy is used.
+*/
+func NewCacheBolt(cache MetricCache, sink CacheSink, strategy FlushStrategy) *cacheBolt {
 	bolt := new(cacheBolt)
-	bolt.control = make(chan bool)
 	bolt.cache = cache
 	bolt.sink = sink
+	if strategy == nil {
+		strategy = SortedStrategy{}
+	}
+	bolt.strategy = strategy
+	bolt.stop = make(chan bool)
+	bolt.done = make(chan bool)
 
 	go bolt.run()
 
@@ -135,24 +586,72 @@ func NewCacheBolt(cache MetricCache, sink CacheSink) *cacheBolt {
 }
 
 /*
-	Is there a more idiomatic way of aproaching this? Some way
-	of letting the cache signal that it has more data.
+	Stop the bolt after the key being flushed, if any. Points still in the
+	cache are left there.
 */
+func (bolt *cacheBolt) Close() {
+	close(bolt.stop)
+	<-bolt.done
+}
+
 func (bolt *cacheBolt) run() {
-	backoff := 0.0
-	backoffLimit := 100000.0
+	defer close(bolt.done)
+	notify := bolt.cache.Notify()
 	for {
-		counts := bolt.cache.Counts()
-		if len(counts) == 0 {
-			backoff += 1
-			time.Sleep(time.Duration(math.Min(backoffLimit, math.Pow(backoff, 5))) * time.Millisecond)
-		} else {
-			fmt.Println(counts, len(counts), backoff)
-			// sort the counts
-			for key := range counts {
-				points := bolt.cache.Pop(key)
+		select {
+		case _, ok := <-notify:
+			if !ok {
+				return
+			}
+			bolt.flush()
+		case <-bolt.stop:
+			return
+		}
+	}
+}
+
+/*
+	A cache that knows which keys have crossed a flush threshold.
+*/
+type dueReporter interface {
+	Due() map[string]bool
+}
+
+/*
+	Flush until the strategy finds nothing due or the bolt is closed.
+*/
+func (bolt *cacheBolt) flush() {
+	for keys := bolt.ready(); len(keys) > 0; keys = bolt.ready() {
+		for _, key := range keys {
+			select {
+			case <-bolt.stop:
+				return
+			default:
+			}
+			points := bolt.cache.Pop(key)
+			if len(points) > 0 {
 				bolt.sink.Send(key, points)
 			}
 		}
 	}
 }
+
+/*
+	The keys to flush in strategy order, limited to those that are due if
+	the cache can tell.
+*/
+func (bolt *cacheBolt) ready() []string {
+	keys := bolt.strategy.Order(bolt.cache)
+	reporter, ok := bolt.cache.(dueReporter)
+	if !ok {
+		return keys
+	}
+	due := reporter.Due()
+	ready := keys[:0]
+	for _, key := range keys {
+		if due[key] {
+			ready = append(ready, key)
+		}
+	}
+	return ready
+}
@@ -36,6 +36,23 @@ func TestPop(t *testing.T) {
 	}
 }
 
+func TestGet(t *testing.T) {
+	cache := NewMetricCache()
+	cache.Store(metric("foo.bar"))
+	cache.Store(metric("foo.bar"))
+	result := cache.Get("foo.bar")
+	if len(result) != 2 {
+		t.Fatalf("Expecting Get result to have two items, received %v", len(result))
+	}
+	result[0].value = 0
+	if cache.Size() != 2 {
+		t.Fatalf("Expecting Get to leave Size unchanged")
+	}
+	if popped := cache.Pop("foo.bar"); popped[0].value != 1234 {
+		t.Fatalf("Expecting Get to return a copy of the data points")
+	}
+}
+
 func TestCounts(t *testing.T) {
 	cache := NewMetricCache()
 	cache.Store(metric("foo.bar"))
@@ -81,6 +98,175 @@ func TestClose(t *testing.T) {
 	cache.Store(metric("foo.bar"))
 }
 
+func TestBoundedDropNewest(t *testing.T) {
+	cache := NewBoundedMetricCache(2, 0, DropNewest)
+	cache.Store(&Metric{"foo.bar", DataPoint{1, 1234}})
+	cache.Store(&Metric{"foo.bar", DataPoint{2, 1235}})
+	cache.Store(&Metric{"foo.bar", DataPoint{3, 1236}})
+	if size := cache.Size(); size != 2 {
+		t.Fatalf("Expecting Size to be limited to 2, received %v", size)
+	}
+	if points := cache.Pop("foo.bar"); points[1].value != 2 {
+		t.Fatalf("Expecting the newest point to be dropped, received %v", points)
+	}
+	if dropped := cache.Dropped()[DropNewest]; dropped != 1 {
+		t.Fatalf("Expecting 1 dropped point, received %v", dropped)
+	}
+}
+
+func TestBoundedDropOldest(t *testing.T) {
+	cache := NewBoundedMetricCache(2, 0, DropOldest)
+	cache.Store(&Metric{"foo.bar", DataPoint{1, 1234}})
+	cache.Store(&Metric{"foo.bar", DataPoint{2, 1235}})
+	cache.Store(&Metric{"foo.bar", DataPoint{3, 1236}})
+	cache.Store(&Metric{"foo.baz", DataPoint{4, 1237}})
+	if size := cache.Size(); size != 2 {
+		t.Fatalf("Expecting Size to be limited to 2, received %v", size)
+	}
+	if points := cache.Pop("foo.bar"); points[0].value != 2 || points[1].value != 3 {
+		t.Fatalf("Expecting the oldest point to be dropped, received %v", points)
+	}
+	if dropped := cache.Dropped()[DropOldest]; dropped != 2 {
+		t.Fatalf("Expecting 2 dropped points, received %v", dropped)
+	}
+}
+
+func TestBoundedDropOldestSinglePoint(t *testing.T) {
+	cache := NewBoundedMetricCache(2, 0, DropOldest)
+	cache.Store(&Metric{"foo.bar", DataPoint{1, 1234}})
+	cache.Store(&Metric{"foo.baz", DataPoint{2, 1235}})
+	cache.Store(&Metric{"foo.bar", DataPoint{3, 1236}})
+	if size := cache.Size(); size != 2 {
+		t.Fatalf("Expecting Size to be limited to 2, received %v", size)
+	}
+	if points := cache.Pop("foo.bar"); len(points) != 1 || points[0].value != 3 {
+		t.Fatalf("Expecting the only point to be replaced, received %v", points)
+	}
+	if dropped := cache.Dropped()[DropOldest]; dropped != 1 {
+		t.Fatalf("Expecting 1 dropped point, received %v", dropped)
+	}
+}
+
+func TestBoundedBytes(t *testing.T) {
+	cache := NewBoundedMetricCache(0, cacheKeyBytes+len("foo.bar")+2*dataPointBytes, DropNewest)
+	cache.Store(&Metric{"foo.bar", DataPoint{1, 1234}})
+	cache.Store(&Metric{"foo.bar", DataPoint{2, 1235}})
+	cache.Store(&Metric{"foo.baz", DataPoint{3, 1236}})
+	if size := cache.Size(); size != 2 {
+		t.Fatalf("Expecting Size to be limited by bytes to 2, received %v", size)
+	}
+}
+
+func TestBoundedBlock(t *testing.T) {
+	cache := NewBoundedMetricCache(1, 0, Block)
+	cache.Store(&Metric{"foo.bar", DataPoint{1, 1234}})
+	stored := make(chan bool)
+	go func() {
+		cache.Store(&Metric{"foo.bar", DataPoint{2, 1235}})
+		stored <- true
+	}()
+	select {
+	case <-stored:
+		t.Fatalf("Expecting Store to block while the cache is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if points := cache.Pop("foo.bar"); len(points) != 1 || points[0].value != 1 {
+		t.Fatalf("Invalid points %v", points)
+	}
+	<-stored
+	if points := cache.Pop("foo.bar"); len(points) != 1 || points[0].value != 2 {
+		t.Fatalf("Expecting the blocked point to be stored after Pop, received %v", points)
+	}
+	if blocked := cache.Dropped()[Block]; blocked != 1 {
+		t.Fatalf("Expecting 1 blocked store, received %v", blocked)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	cache := NewMetricCache()
+	cache.Store(metric("foo.bar"))
+	select {
+	case <-cache.Notify():
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting Store to signal Notify")
+	}
+	cache.Close()
+	if _, ok := <-cache.Notify(); ok {
+		t.Fatalf("Expecting Notify to be closed with the cache")
+	}
+}
+
+func TestNotifySizeThreshold(t *testing.T) {
+	cache := NewMetricCache()
+	cache.SetFlushThresholds(3, time.Hour)
+	cache.Store(metric("foo.bar"))
+	cache.Store(metric("foo.bar"))
+	cache.Size()
+	select {
+	case <-cache.Notify():
+		t.Fatalf("Expecting no signal below the size threshold")
+	default:
+	}
+	cache.Store(metric("foo.bar"))
+	select {
+	case <-cache.Notify():
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting a signal at the size threshold")
+	}
+}
+
+func TestNotifyAgeThreshold(t *testing.T) {
+	cache := NewMetricCache()
+	cache.SetFlushThresholds(100, 20*time.Millisecond)
+	start := time.Now()
+	cache.Store(metric("foo.bar"))
+	select {
+	case <-cache.Notify():
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Fatalf("Expecting the signal to wait for the age threshold, received after %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting a signal at the age threshold")
+	}
+}
+
+func TestCacheBoltFlushesOnNotify(t *testing.T) {
+	cache := NewMetricCache()
+	sink := newRecordingSink()
+	bolt := NewCacheBolt(cache, sink, nil)
+	cache.Store(metric("foo.bar"))
+	for i := 0; i < 100 && len(sink.Keys()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if keys := sink.Keys(); len(keys) != 1 || keys[0] != "foo.bar" {
+		t.Fatalf("Expecting foo.bar to be flushed promptly, received %v", keys)
+	}
+	bolt.Close()
+	cache.Close()
+}
+
+func TestCacheBoltFlushesOnlyDueKeys(t *testing.T) {
+	cache := NewMetricCache()
+	cache.SetFlushThresholds(3, time.Hour)
+	sink := newRecordingSink()
+	bolt := NewCacheBolt(cache, sink, nil)
+	cache.Store(metric("foo.baz"))
+	for i := 0; i < 3; i++ {
+		cache.Store(metric("foo.bar"))
+	}
+	for i := 0; i < 100 && len(sink.Keys()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	bolt.Close()
+	if keys := sink.Keys(); len(keys) != 1 || keys[0] != "foo.bar" {
+		t.Fatalf("Expecting only foo.bar to be flushed, received %v", keys)
+	}
+	if points := cache.Get("foo.baz"); len(points) != 1 {
+		t.Fatalf("Expecting foo.baz to stay cached below its thresholds, received %v", points)
+	}
+	cache.Close()
+}
+
 func benchmarkMetricCache(b *testing.B, cache MetricCache) {
 	// create a finished channel
 	finishedFill := make(chan bool)
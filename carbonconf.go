@@ -0,0 +1,301 @@
+package silicon
+
+import (
+	"fmt"
+	"github.com/kless/goconfig/config"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+	Daemon configuration, read from the [cache] section of a carbon.conf
+	style file. Option names follow carbon where there is an equivalent.
+	A port of zero disables that listener and a limit of zero (or "inf")
+	is unlimited.
+*/
+type CarbonConf struct {
+	LocalDataDir       string // LOCAL_DATA_DIR
+	SchemasPath        string // STORAGE_SCHEMAS_CONFIG, relative to CONF_DIR
+	AggregationPath    string // STORAGE_AGGREGATION_CONFIG, relative to CONF_DIR
+	LineReceiverAddr   string // LINE_RECEIVER_INTERFACE and LINE_RECEIVER_PORT
+	PickleReceiverAddr string // PICKLE_RECEIVER_INTERFACE and PICKLE_RECEIVER_PORT
+	UDPReceiverAddr    string // UDP_RECEIVER_INTERFACE and UDP_RECEIVER_PORT, if ENABLE_UDP_LISTENER
+	CacheQueryAddr     string // CACHE_QUERY_INTERFACE and CACHE_QUERY_PORT
+	HTTPQueryAddr      string // HTTP_QUERY_INTERFACE and HTTP_QUERY_PORT
+
+	MaxCacheSize        int    // MAX_CACHE_SIZE in data points
+	MaxCacheBytes       int    // MAX_CACHE_BYTES
+	CacheOverflowPolicy string // CACHE_OVERFLOW_POLICY; drop-newest, drop-oldest or block
+	CacheShards         int    // CACHE_SHARDS
+	CacheWriteStrategy  string // CACHE_WRITE_STRATEGY; max, sorted, naive or timesorted
+
+	MaxUpdatesPerSecond int // MAX_UPDATES_PER_SECOND
+	MaxCreatesPerMinute int // MAX_CREATES_PER_MINUTE
+
+	WALDir         string // WAL_DIR, empty disables the write-ahead log
+	WALSegmentSize int    // WAL_SEGMENT_SIZE in bytes
+
+	TagIndexFile string // TAG_INDEX_FILE, empty disables the tag index and TagDB API
+
+	MaxMetricNameLength int  // MAX_METRIC_NAME_LENGTH in bytes
+	MaxMetricNameDepth  int  // MAX_METRIC_NAME_DEPTH in dot separated nodes
+	SanitizeMetricNames bool // SANITIZE_METRIC_NAMES, replace illegal characters rather than reject
+	ClampInfiniteValues bool // CLAMP_INFINITE_VALUES, store infinity as the largest float rather than reject
+	MaxTimestampAge     int  // MAX_TIMESTAMP_AGE in seconds before now, zero is unlimited
+	MaxTimestampFuture  int  // MAX_TIMESTAMP_FUTURE in seconds after now, zero is unlimited
+	AcceptNowTimestamps bool // ACCEPT_NOW_TIMESTAMPS, take a timestamp of -1 or N as now
+
+	ReconcileInterval int  // RECONCILE_INTERVAL in seconds, zero disables
+	ReconcileApply    bool // RECONCILE_APPLY, resize files rather than only report them
+
+	MaxOpenFiles  int // MAX_OPEN_FILES, Whisper files kept open between writes
+	WriterWorkers int // WRITER_WORKERS, zero gives each open file its own goroutine
+
+	WriteRetries    int    // WRITE_RETRIES of transient errors
+	WriteRetryDelay int    // WRITE_RETRY_DELAY in milliseconds before the first retry, doubled for each after
+	DeadLetterFile  string // DEAD_LETTER_FILE, defaults to deadletter.txt in LOCAL_DATA_DIR
+
+	ShutdownTimeout int    // SHUTDOWN_TIMEOUT in seconds to drain, and then to flush before saving to the recovery file
+	RecoveryFile    string // RECOVERY_FILE, defaults to recovery.txt in LOCAL_DATA_DIR
+}
+
+const carbonConfSection = "cache"
+
+/*
+	Return the configuration used when no file is given, this matches the
+	defaults of carbon-cache.
+*/
+func DefaultCarbonConf() *CarbonConf {
+	return &CarbonConf{
+		LocalDataDir:        "./db",
+		SchemasPath:         "config/storage-schemas.conf",
+		AggregationPath:     "config/storage-aggregation.conf",
+		LineReceiverAddr:    "0.0.0.0:2003",
+		PickleReceiverAddr:  "0.0.0.0:2004",
+		CacheQueryAddr:      "0.0.0.0:7002",
+		HTTPQueryAddr:       "0.0.0.0:8080",
+		CacheOverflowPolicy: "drop-newest",
+		CacheShards:         1,
+		CacheWriteStrategy:  "sorted",
+		MaxUpdatesPerSecond: 500,
+		MaxCreatesPerMinute: 50,
+		WALSegmentSize:      64 * 1024 * 1024,
+		MaxMetricNameLength: 1024,
+		MaxMetricNameDepth:  64,
+		AcceptNowTimestamps: true,
+		MaxOpenFiles:        50,
+		WriteRetries:        3,
+		WriteRetryDelay:     100,
+		ShutdownTimeout:     60,
+	}
+}
+
+/*
+	Read a carbon.conf style file over the defaults. Every problem found is
+	reported, not just the first.
+*/
+func ParseCarbonConf(confPath string) (*CarbonConf, error) {
+	file, err := config.ReadDefault(confPath)
+	if err != nil {
+		return nil, err
+	}
+	if !file.HasSection(carbonConfSection) {
+		return nil, fmt.Errorf("Invalid config %v: missing [%v] section", confPath, carbonConfSection)
+	}
+	parser := &carbonConfParser{file: file}
+	conf := DefaultCarbonConf()
+
+	confDir := parser.string("CONF_DIR", path.Dir(confPath))
+	conf.LocalDataDir = parser.string("LOCAL_DATA_DIR", conf.LocalDataDir)
+	conf.SchemasPath = parser.string("STORAGE_SCHEMAS_CONFIG", path.Join(confDir, "storage-schemas.conf"))
+	conf.AggregationPath = parser.string("STORAGE_AGGREGATION_CONFIG", path.Join(confDir, "storage-aggregation.conf"))
+	conf.LineReceiverAddr = parser.address("LINE_RECEIVER", conf.LineReceiverAddr)
+	conf.PickleReceiverAddr = parser.address("PICKLE_RECEIVER", conf.PickleReceiverAddr)
+	if parser.bool("ENABLE_UDP_LISTENER", false) {
+		conf.UDPReceiverAddr = parser.address("UDP_RECEIVER", "0.0.0.0:2003")
+	}
+	conf.CacheQueryAddr = parser.address("CACHE_QUERY", conf.CacheQueryAddr)
+	conf.HTTPQueryAddr = parser.address("HTTP_QUERY", conf.HTTPQueryAddr)
+	conf.MaxCacheSize = parser.limit("MAX_CACHE_SIZE", conf.MaxCacheSize)
+	conf.MaxCacheBytes = parser.limit("MAX_CACHE_BYTES", conf.MaxCacheBytes)
+	conf.CacheOverflowPolicy = parser.string("CACHE_OVERFLOW_POLICY", conf.CacheOverflowPolicy)
+	conf.CacheShards = parser.limit("CACHE_SHARDS", conf.CacheShards)
+	conf.CacheWriteStrategy = parser.string("CACHE_WRITE_STRATEGY", conf.CacheWriteStrategy)
+	conf.MaxUpdatesPerSecond = parser.limit("MAX_UPDATES_PER_SECOND", conf.MaxUpdatesPerSecond)
+	conf.MaxCreatesPerMinute = parser.limit("MAX_CREATES_PER_MINUTE", conf.MaxCreatesPerMinute)
+	conf.WALDir = parser.string("WAL_DIR", conf.WALDir)
+	conf.WALSegmentSize = parser.limit("WAL_SEGMENT_SIZE", conf.WALSegmentSize)
+	conf.TagIndexFile = parser.string("TAG_INDEX_FILE", conf.TagIndexFile)
+	conf.MaxMetricNameLength = parser.limit("MAX_METRIC_NAME_LENGTH", conf.MaxMetricNameLength)
+	conf.MaxMetricNameDepth = parser.limit("MAX_METRIC_NAME_DEPTH", conf.MaxMetricNameDepth)
+	conf.SanitizeMetricNames = parser.bool("SANITIZE_METRIC_NAMES", conf.SanitizeMetricNames)
+	conf.ClampInfiniteValues = parser.bool("CLAMP_INFINITE_VALUES", conf.ClampInfiniteValues)
+	conf.MaxTimestampAge = parser.limit("MAX_TIMESTAMP_AGE", conf.MaxTimestampAge)
+	conf.MaxTimestampFuture = parser.limit("MAX_TIMESTAMP_FUTURE", conf.MaxTimestampFuture)
+	conf.AcceptNowTimestamps = parser.bool("ACCEPT_NOW_TIMESTAMPS", conf.AcceptNowTimestamps)
+	conf.ReconcileInterval = parser.limit("RECONCILE_INTERVAL", conf.ReconcileInterval)
+	conf.ReconcileApply = parser.bool("RECONCILE_APPLY", conf.ReconcileApply)
+	conf.MaxOpenFiles = parser.limit("MAX_OPEN_FILES", conf.MaxOpenFiles)
+	conf.WriterWorkers = parser.limit("WRITER_WORKERS", conf.WriterWorkers)
+	conf.WriteRetries = parser.limit("WRITE_RETRIES", conf.WriteRetries)
+	conf.WriteRetryDelay = parser.limit("WRITE_RETRY_DELAY", conf.WriteRetryDelay)
+	conf.DeadLetterFile = parser.string("DEAD_LETTER_FILE", conf.DeadLetterFile)
+	conf.ShutdownTimeout = parser.limit("SHUTDOWN_TIMEOUT", conf.ShutdownTimeout)
+	conf.RecoveryFile = parser.string("RECOVERY_FILE", conf.RecoveryFile)
+
+	if len(parser.errors) > 0 {
+		return nil, fmt.Errorf("Invalid config %v: %v", confPath, strings.Join(parser.errors, "; "))
+	}
+	return conf, nil
+}
+
+/*
+	Check that the configuration is usable, reporting every problem found.
+*/
+func (conf *CarbonConf) Validate() error {
+	var errors []string
+	if conf.LocalDataDir == "" {
+		errors = append(errors, "LOCAL_DATA_DIR must be set")
+	}
+	if conf.SchemasPath == "" {
+		errors = append(errors, "STORAGE_SCHEMAS_CONFIG must be set")
+	}
+	if conf.AggregationPath == "" {
+		errors = append(errors, "STORAGE_AGGREGATION_CONFIG must be set")
+	}
+	if conf.LineReceiverAddr == "" && conf.PickleReceiverAddr == "" && conf.UDPReceiverAddr == "" {
+		errors = append(errors, "at least one receiver must be enabled")
+	}
+	if _, err := ParseOverflowPolicy(conf.CacheOverflowPolicy); err != nil {
+		errors = append(errors, "CACHE_OVERFLOW_POLICY "+err.Error())
+	}
+	if _, err := NewFlushStrategy(conf.CacheWriteStrategy); err != nil {
+		errors = append(errors, "CACHE_WRITE_STRATEGY "+err.Error())
+	}
+	for name, value := range map[string]int{
+		"MAX_CACHE_SIZE":         conf.MaxCacheSize,
+		"MAX_CACHE_BYTES":        conf.MaxCacheBytes,
+		"MAX_UPDATES_PER_SECOND": conf.MaxUpdatesPerSecond,
+		"MAX_CREATES_PER_MINUTE": conf.MaxCreatesPerMinute,
+		"MAX_METRIC_NAME_LENGTH": conf.MaxMetricNameLength,
+		"MAX_METRIC_NAME_DEPTH":  conf.MaxMetricNameDepth,
+		"MAX_TIMESTAMP_AGE":      conf.MaxTimestampAge,
+		"MAX_TIMESTAMP_FUTURE":   conf.MaxTimestampFuture,
+		"RECONCILE_INTERVAL":     conf.ReconcileInterval,
+		"MAX_OPEN_FILES":         conf.MaxOpenFiles,
+		"WRITER_WORKERS":         conf.WriterWorkers,
+		"WRITE_RETRIES":          conf.WriteRetries,
+		"WRITE_RETRY_DELAY":      conf.WriteRetryDelay,
+		"SHUTDOWN_TIMEOUT":       conf.ShutdownTimeout,
+	} {
+		if value < 0 {
+			errors = append(errors, fmt.Sprintf("%v must not be negative", name))
+		}
+	}
+	if conf.CacheShards < 1 {
+		errors = append(errors, "CACHE_SHARDS must be at least 1")
+	}
+	if conf.WriterWorkers == 0 && conf.MaxOpenFiles < 1 {
+		errors = append(errors, "MAX_OPEN_FILES must be at least 1 unless WRITER_WORKERS is set")
+	}
+	if conf.WALDir != "" && conf.WALSegmentSize < 1 {
+		errors = append(errors, "WAL_SEGMENT_SIZE must be at least 1")
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("Invalid config: %v", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+/*
+	Reads typed options from the [cache] section, collecting errors rather
+	than stopping at the first.
+*/
+type carbonConfParser struct {
+	file   *config.Config
+	errors []string
+}
+
+func (parser *carbonConfParser) raw(option string) (string, bool) {
+	if !parser.file.HasOption(carbonConfSection, option) {
+		return "", false
+	}
+	value, err := parser.file.String(carbonConfSection, option)
+	if err != nil {
+		parser.errors = append(parser.errors, fmt.Sprintf("%v: %v", option, err))
+		return "", false
+	}
+	return strings.TrimSpace(value), true
+}
+
+func (parser *carbonConfParser) string(option, defaultValue string) string {
+	if value, ok := parser.raw(option); ok {
+		return value
+	}
+	return defaultValue
+}
+
+func (parser *carbonConfParser) bool(option string, defaultValue bool) bool {
+	value, ok := parser.raw(option)
+	if !ok {
+		return defaultValue
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0":
+		return false
+	}
+	parser.errors = append(parser.errors, fmt.Sprintf("%v: invalid boolean '%v'", option, value))
+	return defaultValue
+}
+
+/*
+	Parse a non-negative integer where "inf" means unlimited (zero).
+*/
+func (parser *carbonConfParser) limit(option string, defaultValue int) int {
+	value, ok := parser.raw(option)
+	if !ok {
+		return defaultValue
+	}
+	if strings.ToLower(value) == "inf" {
+		return 0
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		parser.errors = append(parser.errors, fmt.Sprintf("%v: invalid number '%v'", option, value))
+		return defaultValue
+	}
+	return result
+}
+
+/*
+	Build a listen address from the <prefix>_INTERFACE and <prefix>_PORT
+	options, a port of zero disables the listener.
+*/
+func (parser *carbonConfParser) address(prefix, defaultValue string) string {
+	host, port, _ := splitHostPort(defaultValue)
+	host = parser.string(prefix+"_INTERFACE", host)
+	if value, ok := parser.raw(prefix + "_PORT"); ok {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 || number > 65535 {
+			parser.errors = append(parser.errors, fmt.Sprintf("%v_PORT: invalid port '%v'", prefix, value))
+		} else {
+			port = number
+		}
+	}
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v:%v", host, port)
+}
+
+func splitHostPort(address string) (string, int, error) {
+	index := strings.LastIndex(address, ":")
+	if index < 0 {
+		return address, 0, fmt.Errorf("Missing port in '%v'", address)
+	}
+	port, err := strconv.Atoi(address[index+1:])
+	return address[:index], port, err
+}
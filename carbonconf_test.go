@@ -0,0 +1,66 @@
+package silicon
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeCarbonConf(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "carbon.conf")
+	if err != nil {
+		t.Fatalf("Failed to create config: %v", err)
+	}
+	file.WriteString(contents)
+	file.Close()
+	return file.Name()
+}
+
+func TestParseCarbonConf(t *testing.T) {
+	conf, err := ParseCarbonConf("config/carbon.conf")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expecting sample config to be valid: %v", err)
+	}
+	if conf.LineReceiverAddr != "0.0.0.0:2003" || conf.PickleReceiverAddr != "0.0.0.0:2004" {
+		t.Fatalf("Invalid receiver addresses %v, %v", conf.LineReceiverAddr, conf.PickleReceiverAddr)
+	}
+	if conf.UDPReceiverAddr != "" {
+		t.Fatalf("Expecting the UDP listener to be disabled")
+	}
+	if conf.SchemasPath != "config/storage-schemas.conf" {
+		t.Fatalf("Expecting schemas under CONF_DIR, received %v", conf.SchemasPath)
+	}
+	if conf.MaxCacheSize != 0 || conf.MaxUpdatesPerSecond != 500 {
+		t.Fatalf("Invalid limits %v, %v", conf.MaxCacheSize, conf.MaxUpdatesPerSecond)
+	}
+}
+
+func TestParseCarbonConfErrors(t *testing.T) {
+	path := writeCarbonConf(t, "[cache]\nLINE_RECEIVER_PORT = abc\nMAX_CACHE_SIZE = -1\n")
+	defer os.Remove(path)
+
+	_, err := ParseCarbonConf(path)
+	if err == nil {
+		t.Fatalf("Expecting invalid options to fail")
+	}
+	if !strings.Contains(err.Error(), "LINE_RECEIVER_PORT") || !strings.Contains(err.Error(), "MAX_CACHE_SIZE") {
+		t.Fatalf("Expecting every invalid option to be reported, received %v", err)
+	}
+}
+
+func TestCarbonConfValidate(t *testing.T) {
+	conf := DefaultCarbonConf()
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Expecting defaults to be valid: %v", err)
+	}
+	conf.CacheWriteStrategy = "random"
+	conf.CacheShards = 0
+	err := conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), "CACHE_WRITE_STRATEGY") || !strings.Contains(err.Error(), "CACHE_SHARDS") {
+		t.Fatalf("Expecting strategy and shards errors, received %v", err)
+	}
+}
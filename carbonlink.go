@@ -0,0 +1,158 @@
+package silicon
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+/*
+	Answers CarbonLink queries from graphite-web so that points still in the
+	cache can be rendered. Requests and responses are length prefixed
+	pickled dicts, the supported request types are `cache-query`,
+	`cache-query-bulk` and `get-metadata`.
+*/
+type CarbonLinkListener struct {
+	loop     *acceptLoop
+	cache    MetricCache
+	basePath string
+	resolver StorageResolver
+}
+
+/*
+	Create a new CarbonLink listener. Metadata is read from the Whisper
+	files under `basePath`, falling back to resolver for keys that have not
+	been written yet.
+*/
+func NewCarbonLinkListener(listener net.Listener, cache MetricCache, basePath string, resolver StorageResolver) *CarbonLinkListener {
+	carbonLink := &CarbonLinkListener{cache: cache, basePath: basePath, resolver: resolver}
+	carbonLink.loop = newAcceptLoop(listener, carbonLink.serve)
+
+	return carbonLink
+}
+
+/*
+	Stop accepting connections and answer the requests already read, see
+	acceptLoop.Shutdown.
+*/
+func (carbonLink *CarbonLinkListener) Shutdown(ctx context.Context) error {
+	return carbonLink.loop.Shutdown(ctx)
+}
+
+func (carbonLink *CarbonLinkListener) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				log.Printf("CarbonLink read error: %v", err)
+			}
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > maxPickleLength {
+			log.Printf("CarbonLink request too long: %v bytes", length)
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			log.Printf("CarbonLink read error: %v", err)
+			return
+		}
+		response, err := pickle(carbonLink.handle(payload))
+		if err != nil {
+			log.Printf("CarbonLink response error: %v", err)
+			return
+		}
+		binary.BigEndian.PutUint32(header, uint32(len(response)))
+		if _, err := conn.Write(append(header, response...)); err != nil {
+			log.Printf("CarbonLink write error: %v", err)
+			return
+		}
+	}
+}
+
+func (carbonLink *CarbonLinkListener) handle(payload []byte) map[string]interface{} {
+	data, err := unpickle(payload)
+	if err != nil {
+		return carbonLinkError(err.Error())
+	}
+	request, ok := data.(map[string]interface{})
+	if !ok {
+		return carbonLinkError("Invalid request")
+	}
+	switch request["type"] {
+	case "cache-query":
+		metric, ok := request["metric"].(string)
+		if !ok {
+			return carbonLinkError("Missing metric")
+		}
+		return map[string]interface{}{"datapoints": carbonLink.datapoints(metric)}
+	case "cache-query-bulk":
+		metrics, ok := request["metrics"].([]interface{})
+		if !ok {
+			return carbonLinkError("Missing metrics")
+		}
+		result := make(map[string]interface{}, len(metrics))
+		for _, metric := range metrics {
+			if metric, ok := metric.(string); ok {
+				result[metric] = carbonLink.datapoints(metric)
+			}
+		}
+		return map[string]interface{}{"datapointsByMetric": result}
+	case "get-metadata":
+		metric, ok := request["metric"].(string)
+		if !ok {
+			return carbonLinkError("Missing metric")
+		}
+		key, _ := request["key"].(string)
+		value, err := carbonLink.metadata(metric, key)
+		if err != nil {
+			return carbonLinkError(err.Error())
+		}
+		return map[string]interface{}{"value": value}
+	}
+	return carbonLinkError(fmt.Sprintf("Invalid request type \"%v\"", request["type"]))
+}
+
+func (carbonLink *CarbonLinkListener) datapoints(metric string) []interface{} {
+	points := carbonLink.cache.Get(metric)
+	result := make([]interface{}, len(points))
+	for i, point := range points {
+		result[i] = pickleTuple{point.timestamp, point.value}
+	}
+	return result
+}
+
+func (carbonLink *CarbonLinkListener) metadata(metric, key string) (interface{}, error) {
+	if err := checkQueryKey(metric); err != nil {
+		return nil, err
+	}
+	header, err := readWhisperHeader(WhisperPath(carbonLink.basePath, metric))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if header == nil {
+		_, aggregationMethod, xFilesFactor, err := carbonLink.resolver.Find(metric)
+		if err != nil {
+			return nil, err
+		}
+		header = &whisperHeader{aggregationMethod: aggregationMethod, xFilesFactor: xFilesFactor}
+	}
+	switch key {
+	case "aggregationMethod":
+		return aggregationMethodName(header.aggregationMethod), nil
+	case "xFilesFactor":
+		return float64(header.xFilesFactor), nil
+	}
+	return nil, fmt.Errorf("Unsupported metadata key \"%v\"", key)
+}
+
+func carbonLinkError(message string) map[string]interface{} {
+	return map[string]interface{}{"error": message}
+}
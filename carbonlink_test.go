@@ -0,0 +1,96 @@
+package silicon
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+const (
+	cacheQueryRequest     = "\x80\x04\x95-\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x04type\x94\x8c\x0bcache-query\x94\x8c\x06metric\x94\x8c\x07foo.bar\x94u."
+	cacheQueryBulkRequest = "\x80\x02}q\x00(X\x04\x00\x00\x00typeq\x01X\x10\x00\x00\x00cache-query-bulkq\x02X\x07\x00\x00\x00metricsq\x03]q\x04(X\x07\x00\x00\x00foo.barq\x05X\x07\x00\x00\x00foo.bazq\x06eu."
+	getMetadataRequest    = "(dp0\nVtype\np1\nVget-metadata\np2\nsVmetric\np3\nVfoo.bar\np4\nsVkey\np5\nVaggregationMethod\np6\ns."
+)
+
+func carbonLinkQuery(t *testing.T, conn net.Conn, request string) map[string]interface{} {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(request)))
+	conn.Write(append(header, request...))
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	response, err := unpickle(payload)
+	if err != nil {
+		t.Fatalf("Failed to unpickle response: %v", err)
+	}
+	return response.(map[string]interface{})
+}
+
+func TestCarbonLinkListener(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	cache := NewMetricCache()
+	cache.Store(&Metric{"foo.bar", DataPoint{1.5, 1234}})
+	cache.Store(&Metric{"foo.bar", DataPoint{2.5, 1235}})
+	NewCarbonLinkListener(listener, cache, path, resolver)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	response := carbonLinkQuery(t, conn, cacheQueryRequest)
+	datapoints := response["datapoints"].([]interface{})
+	if len(datapoints) != 2 {
+		t.Fatalf("Expecting 2 datapoints, received %v", response)
+	}
+	if point := datapoints[1].(pickleTuple); point[0] != int64(1235) || point[1] != 2.5 {
+		t.Fatalf("Invalid datapoint %v", point)
+	}
+	if cache.Size() != 2 {
+		t.Fatalf("Expecting cache-query to leave the cache unchanged")
+	}
+
+	response = carbonLinkQuery(t, conn, cacheQueryBulkRequest)
+	byMetric := response["datapointsByMetric"].(map[string]interface{})
+	if len(byMetric["foo.bar"].([]interface{})) != 2 || len(byMetric["foo.baz"].([]interface{})) != 0 {
+		t.Fatalf("Invalid bulk response %v", response)
+	}
+
+	response = carbonLinkQuery(t, conn, getMetadataRequest)
+	if response["value"] != "sum" {
+		t.Fatalf("Expecting aggregation method sum from the resolver, received %v", response)
+	}
+}
+
+func TestCarbonLinkInvalidRequest(t *testing.T) {
+	carbonLink := &CarbonLinkListener{cache: NewMetricCache()}
+	// pickle.dumps({'type': 'foo'}, protocol=2)
+	response := carbonLink.handle([]byte("\x80\x02}q\x00X\x04\x00\x00\x00typeq\x01X\x03\x00\x00\x00fooq\x02s."))
+	if _, ok := response["error"]; !ok {
+		t.Fatalf("Expecting an error for an unknown request type, received %v", response)
+	}
+}
+
+func TestCarbonLinkMetadataOutsideDataDir(t *testing.T) {
+	carbonLink := &CarbonLinkListener{cache: NewMetricCache(), basePath: "/tmp/storage", resolver: new(dummyResolver)}
+	for _, metric := range []string{"../../other", "..", "foo..bar"} {
+		request, _ := pickle(map[string]interface{}{"type": "get-metadata", "metric": metric, "key": "xFilesFactor"})
+		response := carbonLink.handle(request)
+		if _, ok := response["error"]; !ok {
+			t.Errorf("Expecting an error for metric %v, received %v", metric, response)
+		}
+	}
+}
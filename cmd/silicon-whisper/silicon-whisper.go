@@ -0,0 +1,283 @@
+/*
+	Inspect and repair the Whisper files written by silicon. Files can be
+	given by path or by metric key, keys are looked up under -data-dir.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/robyoung/go-silicon"
+	"github.com/robyoung/go-whisper"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dataDir = flag.String("data-dir", "./db", "directory holding the Whisper files, used to find files by key")
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"info":            {"<file>", runInfo},
+		"dump":            {"<file>", runDump},
+		"fetch":           {"[-from timestamp] [-until timestamp] <file>", runFetch},
+		"update":          {"<file> [timestamp:]value ...", runUpdate},
+		"create":          {"[-aggregation method] [-xff factor] <file> precision:retention ...", runCreate},
+		"resize":          {"[-aggregation method] [-xff factor] <file> precision:retention ...", runResize},
+		"set-aggregation": {"<file> method [xff]", runSetAggregation},
+		"merge":           {"<from> <to>", runMerge},
+		"fill":            {"<from> <to>", runFill},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [-data-dir dir] <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "A file is a path ending in .wsp or a metric key.\n\nCommands:\n")
+	for _, name := range []string{"info", "dump", "fetch", "update", "create", "resize", "set-aggregation", "merge", "fill"} {
+		fmt.Fprintf(os.Stderr, "  %v %v\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%v'\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+/*
+	Map a command line argument to a file, anything that looks like a path
+	is used as it is.
+*/
+func filePath(target string) string {
+	if strings.HasSuffix(target, ".wsp") || strings.Contains(target, "/") {
+		return target
+	}
+	return silicon.WhisperPath(*dataDir, target)
+}
+
+func expectArgs(args []string, min int, usage string) error {
+	if len(args) < min {
+		return fmt.Errorf("expecting %v", usage)
+	}
+	return nil
+}
+
+func runInfo(args []string) error {
+	if err := expectArgs(args, 1, commands["info"].usage); err != nil {
+		return err
+	}
+	return silicon.WriteWhisperInfo(filePath(args[0]), os.Stdout)
+}
+
+func runDump(args []string) error {
+	if err := expectArgs(args, 1, commands["dump"].usage); err != nil {
+		return err
+	}
+	return silicon.DumpWhisper(filePath(args[0]), os.Stdout)
+}
+
+func runFetch(args []string) error {
+	now := int(time.Now().Unix())
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	from := flags.Int("from", now-86400, "unix timestamp to fetch from, defaults to a day ago")
+	until := flags.Int("until", now, "unix timestamp to fetch until, defaults to now")
+	flags.Parse(args)
+	if err := expectArgs(flags.Args(), 1, commands["fetch"].usage); err != nil {
+		return err
+	}
+
+	file, err := whisper.Open(filePath(flags.Arg(0)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	series, err := file.Fetch(*from, *until)
+	if err != nil {
+		return err
+	}
+	// nothing is returned for a range outside the file's retention
+	if series == nil {
+		return fmt.Errorf("no data between %v and %v", *from, *until)
+	}
+	for _, point := range series.Points() {
+		if math.IsNaN(point.Value) {
+			fmt.Printf("%v\tNone\n", point.Time)
+		} else {
+			fmt.Printf("%v\t%v\n", point.Time, point.Value)
+		}
+	}
+	return nil
+}
+
+func runUpdate(args []string) error {
+	if err := expectArgs(args, 2, commands["update"].usage); err != nil {
+		return err
+	}
+	now := int(time.Now().Unix())
+	points := make([]*whisper.TimeSeriesPoint, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		point := &whisper.TimeSeriesPoint{Time: now, Value: 0}
+		value := arg
+		if index := strings.Index(arg, ":"); index >= 0 {
+			timestamp, err := strconv.Atoi(arg[:index])
+			if err != nil {
+				return fmt.Errorf("invalid timestamp in '%v'", arg)
+			}
+			point.Time = timestamp
+			value = arg[index+1:]
+		}
+		var err error
+		if point.Value, err = strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("invalid value in '%v'", arg)
+		}
+		points = append(points, point)
+	}
+
+	file, err := whisper.Open(filePath(args[0]))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.UpdateMany(points)
+}
+
+/*
+	Parse the flags and arguments shared by create and resize. Flags that
+	are not given are returned as nil.
+*/
+func parseArchiveArgs(name string, args []string) (target string, retentions whisper.Retentions, aggregationMethod *whisper.AggregationMethod, xFilesFactor *float32, err error) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	aggregation := flags.String("aggregation", "", "average, sum, last, max or min")
+	xff := flags.Float64("xff", -1, "xFilesFactor between 0 and 1")
+	flags.Parse(args)
+	if err = expectArgs(flags.Args(), 2, commands[name].usage); err != nil {
+		return
+	}
+	target = flags.Arg(0)
+	if retentions, err = whisper.ParseRetentionDefs(strings.Join(flags.Args()[1:], ",")); err != nil {
+		return
+	}
+	if *aggregation != "" {
+		method, parseErr := silicon.ParseAggregationMethod(*aggregation)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		aggregationMethod = &method
+	}
+	if *xff >= 0 {
+		if *xff > 1 {
+			err = fmt.Errorf("xFilesFactor %v must be between 0 and 1", *xff)
+			return
+		}
+		factor := float32(*xff)
+		xFilesFactor = &factor
+	}
+	return
+}
+
+func runCreate(args []string) error {
+	target, retentions, aggregationMethod, xFilesFactor, err := parseArchiveArgs("create", args)
+	if err != nil {
+		return err
+	}
+	method, factor := whisper.Average, float32(0.5)
+	if aggregationMethod != nil {
+		method = *aggregationMethod
+	}
+	if xFilesFactor != nil {
+		factor = *xFilesFactor
+	}
+	fullPath := filePath(target)
+	os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+	file, err := whisper.Create(fullPath, retentions, method, factor)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return nil
+}
+
+/*
+	Resize keeps the current aggregation settings unless they are given.
+*/
+func runResize(args []string) error {
+	target, retentions, aggregationMethod, xFilesFactor, err := parseArchiveArgs("resize", args)
+	if err != nil {
+		return err
+	}
+	fullPath := filePath(target)
+	method, factor, err := silicon.WhisperAggregation(fullPath)
+	if err != nil {
+		return err
+	}
+	if aggregationMethod != nil {
+		method = *aggregationMethod
+	}
+	if xFilesFactor != nil {
+		factor = *xFilesFactor
+	}
+	return silicon.ResizeWhisper(fullPath, retentions, method, factor)
+}
+
+func runSetAggregation(args []string) error {
+	if err := expectArgs(args, 2, commands["set-aggregation"].usage); err != nil {
+		return err
+	}
+	fullPath := filePath(args[0])
+	_, factor, err := silicon.WhisperAggregation(fullPath)
+	if err != nil {
+		return err
+	}
+	method, err := silicon.ParseAggregationMethod(args[1])
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		xff, err := strconv.ParseFloat(args[2], 32)
+		if err != nil || xff < 0 || xff > 1 {
+			return fmt.Errorf("xFilesFactor '%v' must be between 0 and 1", args[2])
+		}
+		factor = float32(xff)
+	}
+	return silicon.SetWhisperAggregation(fullPath, method, factor)
+}
+
+func runMerge(args []string) error {
+	if err := expectArgs(args, 2, commands["merge"].usage); err != nil {
+		return err
+	}
+	return silicon.MergeWhisper(filePath(args[0]), filePath(args[1]))
+}
+
+func runFill(args []string) error {
+	if err := expectArgs(args, 2, commands["fill"].usage); err != nil {
+		return err
+	}
+	return silicon.FillWhisper(filePath(args[0]), filePath(args[1]))
+}
@@ -1,27 +1,199 @@
 package main
 
 import (
-	"github.com/robyoung/go-silicon"
+	"context"
+	"flag"
 	"fmt"
-	"net"
-	"os/signal"
+	"github.com/robyoung/go-silicon"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	confPath            = flag.String("config", "", "path to a carbon.conf style config file")
+	localDataDir        = flag.String("data-dir", "", "directory holding the Whisper files (LOCAL_DATA_DIR)")
+	schemasPath         = flag.String("storage-schemas", "", "path to storage-schemas.conf")
+	aggregationPath     = flag.String("storage-aggregation", "", "path to storage-aggregation.conf")
+	lineReceiverAddr    = flag.String("line-addr", "", "plaintext TCP listen address, empty string disables")
+	pickleReceiverAddr  = flag.String("pickle-addr", "", "pickle listen address, empty string disables")
+	udpReceiverAddr     = flag.String("udp-addr", "", "plaintext UDP listen address, empty string disables")
+	cacheQueryAddr      = flag.String("cache-query-addr", "", "CarbonLink listen address, empty string disables")
+	httpQueryAddr       = flag.String("http-addr", "", "HTTP read API listen address, empty string disables")
+	maxCacheSize        = flag.Int("max-cache-size", 0, "maximum data points held in the cache, 0 is unlimited (MAX_CACHE_SIZE)")
+	cacheOverflowPolicy = flag.String("cache-overflow-policy", "", "drop-newest, drop-oldest or block (CACHE_OVERFLOW_POLICY)")
+	cacheShards         = flag.Int("cache-shards", 0, "number of cache partitions (CACHE_SHARDS)")
+	cacheWriteStrategy  = flag.String("cache-write-strategy", "", "max, sorted, naive or timesorted (CACHE_WRITE_STRATEGY)")
+	maxUpdatesPerSecond = flag.Int("max-updates-per-second", 0, "Whisper update limit, 0 is unlimited (MAX_UPDATES_PER_SECOND)")
+	maxCreatesPerMinute = flag.Int("max-creates-per-minute", 0, "Whisper create limit, 0 is unlimited (MAX_CREATES_PER_MINUTE)")
+	walDir              = flag.String("wal-dir", "", "write-ahead log directory, empty string disables (WAL_DIR)")
+	tagIndexFile        = flag.String("tag-index", "", "tag index file, empty string disables (TAG_INDEX_FILE)")
+	maxMetricNameLength = flag.Int("max-metric-name-length", 0, "longest metric name accepted, 0 is unlimited (MAX_METRIC_NAME_LENGTH)")
+	maxMetricNameDepth  = flag.Int("max-metric-name-depth", 0, "most nodes in a metric name, 0 is unlimited (MAX_METRIC_NAME_DEPTH)")
+	sanitizeMetricNames = flag.Bool("sanitize-metric-names", false, "replace illegal characters in metric names rather than reject them (SANITIZE_METRIC_NAMES)")
+	clampInfiniteValues = flag.Bool("clamp-infinite-values", false, "store infinite values as the largest float rather than reject them (CLAMP_INFINITE_VALUES)")
+	maxTimestampAge     = flag.Int("max-timestamp-age", 0, "seconds before now a point may be, 0 is unlimited (MAX_TIMESTAMP_AGE)")
+	maxTimestampFuture  = flag.Int("max-timestamp-future", 0, "seconds after now a point may be, 0 is unlimited (MAX_TIMESTAMP_FUTURE)")
+	acceptNowTimestamps = flag.Bool("accept-now-timestamps", true, "take a timestamp of -1 or N as now (ACCEPT_NOW_TIMESTAMPS)")
+	reconcileInterval   = flag.Int("reconcile-interval", 0, "seconds between Whisper file reconciliations, 0 disables (RECONCILE_INTERVAL)")
+	reconcileApply      = flag.Bool("reconcile-apply", false, "resize files that differ from the storage rules rather than only report them (RECONCILE_APPLY)")
+	maxOpenFiles        = flag.Int("max-open-files", 0, "Whisper files kept open between writes (MAX_OPEN_FILES)")
+	writerWorkers       = flag.Int("writer-workers", 0, "write with this many workers rather than a goroutine per open file, 0 disables (WRITER_WORKERS)")
+	writeRetries        = flag.Int("write-retries", 0, "retries of transient Whisper write errors (WRITE_RETRIES)")
+	writeRetryDelay     = flag.Int("write-retry-delay", 0, "milliseconds before the first retry, doubled for each after (WRITE_RETRY_DELAY)")
+	deadLetterFile      = flag.String("dead-letter-file", "", "file points that cannot be written are appended to (DEAD_LETTER_FILE)")
+	shutdownTimeout     = flag.Int("shutdown-timeout", 0, "seconds to drain, and then to flush, on SIGTERM or SIGINT before saving to the recovery file, 0 is unlimited (SHUTDOWN_TIMEOUT)")
+	recoveryFile        = flag.String("recovery-file", "", "file points not written before the shutdown deadline are saved to (RECOVERY_FILE)")
+	reconcile           = flag.Bool("reconcile", false, "reconcile the Whisper files with the storage rules once and exit")
 )
 
+/*
+	Read the config file, if any, and apply any flags that were given on
+	the command line over it.
+*/
+func loadConf() (*silicon.CarbonConf, error) {
+	conf := silicon.DefaultCarbonConf()
+	if *confPath != "" {
+		var err error
+		conf, err = silicon.ParseCarbonConf(*confPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data-dir":
+			conf.LocalDataDir = *localDataDir
+		case "storage-schemas":
+			conf.SchemasPath = *schemasPath
+		case "storage-aggregation":
+			conf.AggregationPath = *aggregationPath
+		case "line-addr":
+			conf.LineReceiverAddr = *lineReceiverAddr
+		case "pickle-addr":
+			conf.PickleReceiverAddr = *pickleReceiverAddr
+		case "udp-addr":
+			conf.UDPReceiverAddr = *udpReceiverAddr
+		case "cache-query-addr":
+			conf.CacheQueryAddr = *cacheQueryAddr
+		case "http-addr":
+			conf.HTTPQueryAddr = *httpQueryAddr
+		case "max-cache-size":
+			conf.MaxCacheSize = *maxCacheSize
+		case "cache-overflow-policy":
+			conf.CacheOverflowPolicy = *cacheOverflowPolicy
+		case "cache-shards":
+			conf.CacheShards = *cacheShards
+		case "cache-write-strategy":
+			conf.CacheWriteStrategy = *cacheWriteStrategy
+		case "max-updates-per-second":
+			conf.MaxUpdatesPerSecond = *maxUpdatesPerSecond
+		case "max-creates-per-minute":
+			conf.MaxCreatesPerMinute = *maxCreatesPerMinute
+		case "wal-dir":
+			conf.WALDir = *walDir
+		case "tag-index":
+			conf.TagIndexFile = *tagIndexFile
+		case "max-metric-name-length":
+			conf.MaxMetricNameLength = *maxMetricNameLength
+		case "max-metric-name-depth":
+			conf.MaxMetricNameDepth = *maxMetricNameDepth
+		case "sanitize-metric-names":
+			conf.SanitizeMetricNames = *sanitizeMetricNames
+		case "clamp-infinite-values":
+			conf.ClampInfiniteValues = *clampInfiniteValues
+		case "max-timestamp-age":
+			conf.MaxTimestampAge = *maxTimestampAge
+		case "max-timestamp-future":
+			conf.MaxTimestampFuture = *maxTimestampFuture
+		case "accept-now-timestamps":
+			conf.AcceptNowTimestamps = *acceptNowTimestamps
+		case "reconcile-interval":
+			conf.ReconcileInterval = *reconcileInterval
+		case "reconcile-apply":
+			conf.ReconcileApply = *reconcileApply
+		case "max-open-files":
+			conf.MaxOpenFiles = *maxOpenFiles
+		case "writer-workers":
+			conf.WriterWorkers = *writerWorkers
+		case "write-retries":
+			conf.WriteRetries = *writeRetries
+		case "write-retry-delay":
+			conf.WriteRetryDelay = *writeRetryDelay
+		case "dead-letter-file":
+			conf.DeadLetterFile = *deadLetterFile
+		case "shutdown-timeout":
+			conf.ShutdownTimeout = *shutdownTimeout
+		case "recovery-file":
+			conf.RecoveryFile = *recoveryFile
+		}
+	})
+	return conf, conf.Validate()
+}
+
+/*
+	Report, and with -reconcile-apply fix, every file that differs from the
+	storage rules. The daemon should not be writing to the files.
+*/
+func runReconcile(conf *silicon.CarbonConf) {
+	storageResolver, err := silicon.NewFileStorageResolver(conf.SchemasPath, conf.AggregationPath)
+	if err != nil {
+		log.Fatalf("Failed to read storage config: %v", err)
+	}
+	reconciler := silicon.NewReconciler(conf.LocalDataDir, storageResolver)
+	if conf.TagIndexFile != "" {
+		tagIndex, err := silicon.OpenTagIndex(conf.TagIndexFile)
+		if err != nil {
+			log.Fatalf("Failed to open tag index: %v", err)
+		}
+		defer tagIndex.Close()
+		reconciler.SetTagIndex(tagIndex)
+	}
+	reconciliations, err := reconciler.Run(conf.ReconcileApply)
+	for _, reconciliation := range reconciliations {
+		if reconciliation.Applied {
+			fmt.Printf("reconciled %v\n", reconciliation)
+		} else {
+			fmt.Printf("%v\n", reconciliation)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to reconcile: %v", err)
+	}
+}
+
 func main() {
-	metricCache := silicon.NewMetricCache()
-	storageResolver, err := silicon.NewFileStorageResolver("config/storage-schemas.conf", "config/storage-aggregation.conf")
-	storageWriter := silicon.NewWriter("./db", storageResolver)
-	cacheBolt := silicon.NewCacheBolt(metricCache, storageWriter)
-	listener, err := net.Listen("tcp", ":2003")
+	flag.Parse()
+	conf, err := loadConf()
 	if err != nil {
-		fmt.Printf("Failed to listen: %v", err)
+		log.Fatalf("%v", err)
+	}
+	if *reconcile {
+		runReconcile(conf)
+		return
 	}
-	receiver := silicon.NewMetricReceiver(listener, metricCache)
 
-	fmt.Println(receiver, cacheBolt)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, syscall.SIGTERM, syscall.SIGINT)
+	ctx, cancel := context.WithCancel(context.Background())
+	server := silicon.NewServer(silicon.ServerOptions{Conf: conf, Reload: hup})
+	if err := server.Start(ctx); err != nil {
+		log.Fatalf("%v", err)
+	}
+	go func() {
+		received := <-interrupted
+		log.Printf("Received %v, shutting down", received)
+		// a second signal kills the process straight away
+		signal.Stop(interrupted)
+		cancel()
+	}()
 
-	interrupted := make(chan os.Signal)
-	signal.Notify(interrupted, os.Kill)
-	<-interrupted
+	// connections still open at the deadline are closed, that is expected
+	if err := server.Wait(); err != nil && err != context.DeadlineExceeded {
+		log.Fatalf("Failed to shut down cleanly: %v", err)
+	}
+	log.Printf("Shut down")
 }
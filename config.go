@@ -4,100 +4,444 @@ import (
 	"fmt"
 	"github.com/kless/goconfig/config"
 	"github.com/robyoung/go-whisper"
+	"log"
+	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 /*
-storageSchemas, err := ParseStorageSchemas(path)
-retentions, err := storageSchemas.Retentions(key)
+	storageSchemas, err := ParseStorageSchemas(path)
+	retentions, err := storageSchemas.Retentions(key)
 
-carbonConf, err := ParseCarbonConf(path)
-carbonConf.Get("CARBON_PATH")
+	carbonConf, err := ParseCarbonConf(path)
+	carbonConf.Get("CARBON_PATH")
 */
 
 /*
 	Retrieve Whisper configuration details for a given key from a file.
 */
 type fileStorageResolver struct {
-	schemas     *config.Config
-	aggregation *config.Config
+	schemasPath     string
+	aggregationPath string
+	lock            sync.RWMutex
+	rules           *storageRules
+	modified        time.Time
+}
+
+/*
+	The parsed contents of storage-schemas.conf and storage-aggregation.conf.
+	Patterns are compiled and definitions validated once when the files are
+	read. Rules are matched in file order and the first match wins.
+*/
+type storageRules struct {
+	schemas      []*schemaRule
+	aggregations []*aggregationRule
+}
+
+/*
+	Matches a pattern against the series name and, if any are given,
+	patterns against tag values. A rule with tag patterns only matches
+	tagged series that have every tag.
+*/
+type storageMatcher struct {
+	pattern *regexp.Regexp
+	tags    map[string]*regexp.Regexp
+	tagDefs string
+}
+
+type schemaRule struct {
+	name string
+	*storageMatcher
+	retentionDefs string
+	retentions    whisper.Retentions
+}
+
+/*
+	The values Whisper uses when a file is created without them.
+*/
+const (
+	defaultAggregationMethod = whisper.Average
+	defaultXFilesFactor      = 0.5
+)
+
+type aggregationRule struct {
+	name string
+	*storageMatcher
+	aggregationMethod whisper.AggregationMethod
+	xFilesFactor      float32
 }
 
 func NewFileStorageResolver(schemasPath, aggregationPath string) (*fileStorageResolver, error) {
 	resolver := new(fileStorageResolver)
-	schemas, err := config.ReadDefault(schemasPath)
-	if err != nil {
+	resolver.schemasPath = schemasPath
+	resolver.aggregationPath = aggregationPath
+	if err := resolver.Reload(); err != nil {
 		return nil, err
 	}
-	resolver.schemas = schemas
-	aggregation, err := config.ReadDefault(aggregationPath)
+
+	return resolver, nil
+}
+
+/*
+	Read both files again and swap in the new rules, but only if they parse
+	and validate. On error the current rules are kept.
+*/
+func (resolver *fileStorageResolver) Reload() error {
+	modified := latestModified(resolver.schemasPath, resolver.aggregationPath)
+	rules, err := parseStorageRules(resolver.schemasPath, resolver.aggregationPath)
+
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	// record the attempt either way so that Watch does not retry a broken
+	// file on every tick, only once it changes again
+	resolver.modified = modified
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if resolver.rules != nil {
+		for _, change := range resolver.rules.changes(rules) {
+			log.Printf("Storage config: %v", change)
+		}
 	}
-	resolver.aggregation = aggregation
+	resolver.rules = rules
 
-	return resolver, nil
+	return nil
+}
+
+/*
+	Reload whenever either file changes, checking every interval, and
+	whenever a value arrives on hup (typically SIGHUP). Stops when stop is
+	closed.
+*/
+func (resolver *fileStorageResolver) Watch(interval time.Duration, hup <-chan os.Signal, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			resolver.lock.RLock()
+			unchanged := !latestModified(resolver.schemasPath, resolver.aggregationPath).After(resolver.modified)
+			resolver.lock.RUnlock()
+			if unchanged {
+				continue
+			}
+		case <-hup:
+		case <-stop:
+			return
+		}
+		if err := resolver.Reload(); err != nil {
+			log.Printf("Failed to reload storage config, keeping the current rules: %v", err)
+		}
+	}
+}
+
+func latestModified(paths ...string) time.Time {
+	var latest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
 }
 
 func (resolver *fileStorageResolver) Find(key string) (retentions whisper.Retentions, aggregationMethod whisper.AggregationMethod, xFilesFactor float32, err error) {
-	retentions, err = resolver.findRetentions(key)
-	if err != nil {
-		return nil, 0, 0, err
+	resolver.lock.RLock()
+	rules := resolver.rules
+	resolver.lock.RUnlock()
+
+	name, tags := key, map[string]string(nil)
+	if isTagged(key) {
+		if name, tags, err = parseTaggedKey(key); err != nil {
+			return nil, 0, 0, err
+		}
 	}
-	aggregationMethod, xFilesFactor, err = resolver.findAggregation(key)
+	retentions, err = rules.findRetentions(name, tags)
 	if err != nil {
 		return nil, 0, 0, err
 	}
+	aggregationMethod, xFilesFactor = rules.findAggregation(name, tags)
 
 	return
 }
 
-func (resolver *fileStorageResolver) findRetentions(key string) (whisper.Retentions, error) {
-	for _, section := range resolver.schemas.Sections()[1:] {
-		pattern, err := resolver.schemas.String(section, "pattern")
-		if err == nil {
-			if regexp.MustCompile(pattern).MatchString(key) {
-				retentionDef, err := resolver.schemas.String(section, "retentions")
-				if err != nil {
-					return nil, fmt.Errorf("Could not find retentions option for %v", section)
-				}
-				return whisper.ParseRetentionDefs(retentionDef)
+func (rules *storageRules) findRetentions(name string, tags map[string]string) (whisper.Retentions, error) {
+	for _, rule := range rules.schemas {
+		if rule.matches(name, tags) {
+			return rule.retentions, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find retention defs for '%v'", formatTaggedKey(name, tags))
+}
+
+/*
+	As with carbon, a key that matches no rule gets Whisper's defaults.
+*/
+func (rules *storageRules) findAggregation(name string, tags map[string]string) (whisper.AggregationMethod, float32) {
+	for _, rule := range rules.aggregations {
+		if rule.matches(name, tags) {
+			return rule.aggregationMethod, rule.xFilesFactor
+		}
+	}
+	return defaultAggregationMethod, defaultXFilesFactor
+}
+
+/*
+	Parse and validate both files. Every problem found is reported along
+	with the file and section it is in, not just the first.
+*/
+func parseStorageRules(schemasPath, aggregationPath string) (*storageRules, error) {
+	var errors []string
+	rules := new(storageRules)
+
+	schemas, err := config.ReadDefault(schemasPath)
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("%v: %v", schemasPath, err))
+	} else {
+		for _, section := range schemas.Sections()[1:] {
+			rule, err := parseSchemaRule(schemas, section)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%v [%v] %v", schemasPath, section, err))
+			} else {
+				rules.schemas = append(rules.schemas, rule)
 			}
 		}
 	}
-	return nil, fmt.Errorf("Could not find retention defs for '%v'", key)
-}
-
-func (resolver *fileStorageResolver) findAggregation(key string) (whisper.AggregationMethod, float32, error) {
-	for _, section := range resolver.aggregation.Sections()[1:] {
-		pattern, err := resolver.aggregation.String(section, "pattern")
-		if err == nil {
-			if regexp.MustCompile(pattern).MatchString(key) {
-				aggregationMethodS, err := resolver.aggregation.String(section, "aggregationMethod")
-				if err != nil {
-					return 0, 0, err
-				}
-				aggregationMethod, err := resolver.parseAggregationMethod(aggregationMethodS)
-				if err != nil {
-					return 0, 0, err
-				}
-				xFilesFactor, err := resolver.aggregation.Float(section, "xFilesFactor")
-				if err != nil {
-					return 0, 0, err
-				}
-				return aggregationMethod, float32(xFilesFactor), nil
+
+	aggregation, err := config.ReadDefault(aggregationPath)
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("%v: %v", aggregationPath, err))
+	} else {
+		for _, section := range aggregation.Sections()[1:] {
+			rule, err := parseAggregationRule(aggregation, section)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%v [%v] %v", aggregationPath, section, err))
+			} else {
+				rules.aggregations = append(rules.aggregations, rule)
 			}
 		}
 	}
-	return 0, 0, fmt.Errorf("Could not find aggregation defs for '%v'", key)
+
+	if len(errors) > 0 {
+		return nil, fmt.Errorf("Invalid storage config: %v", strings.Join(errors, "; "))
+	}
+	return rules, nil
+}
+
+func (matcher *storageMatcher) matches(name string, tags map[string]string) bool {
+	if !matcher.pattern.MatchString(name) {
+		return false
+	}
+	for tag, pattern := range matcher.tags {
+		value, found := tags[tag]
+		if !found || !pattern.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Read the pattern option and the optional tags option, which is a ;
+	separated list of tag=pattern.
+*/
+func parseMatcher(c *config.Config, section string) (*storageMatcher, error) {
+	pattern, err := c.String(section, "pattern")
+	if err != nil {
+		return nil, fmt.Errorf("missing pattern")
+	}
+	matcher := new(storageMatcher)
+	if matcher.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	if !c.HasOption(section, "tags") {
+		return matcher, nil
+	}
+	if matcher.tagDefs, err = c.String(section, "tags"); err != nil {
+		return nil, fmt.Errorf("invalid tags: %v", err)
+	}
+	matcher.tags = make(map[string]*regexp.Regexp)
+	for _, tagDef := range strings.Split(matcher.tagDefs, ";") {
+		tagDef = strings.TrimSpace(tagDef)
+		index := strings.Index(tagDef, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("invalid tags '%v', expecting tag=pattern", tagDef)
+		}
+		tag := strings.TrimSpace(tagDef[:index])
+		if matcher.tags[tag], err = regexp.Compile(strings.TrimSpace(tagDef[index+1:])); err != nil {
+			return nil, fmt.Errorf("invalid pattern for tag %v: %v", tag, err)
+		}
+	}
+	return matcher, nil
 }
 
-func (resolver *fileStorageResolver) parseAggregationMethod(aggregationMethod string) (whisper.AggregationMethod, error) {
+func (matcher *storageMatcher) String() string {
+	if matcher.tagDefs == "" {
+		return fmt.Sprintf("pattern = %v", matcher.pattern)
+	}
+	return fmt.Sprintf("pattern = %v, tags = %v", matcher.pattern, matcher.tagDefs)
+}
+
+func parseSchemaRule(c *config.Config, section string) (*schemaRule, error) {
+	matcher, err := parseMatcher(c, section)
+	if err != nil {
+		return nil, err
+	}
+	retentionDefs, err := c.String(section, "retentions")
+	if err != nil {
+		return nil, fmt.Errorf("missing retentions")
+	}
+	retentions, err := whisper.ParseRetentionDefs(retentionDefs)
+	if err == nil {
+		err = validateRetentions(retentions)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid retentions '%v': %v", retentionDefs, err)
+	}
+	sort.Sort(retentionsByPrecision(retentions))
+	return &schemaRule{section, matcher, retentionDefs, retentions}, nil
+}
+
+/*
+	Both xFilesFactor and aggregationMethod are optional, falling back to
+	Whisper's defaults as carbon does.
+*/
+func parseAggregationRule(c *config.Config, section string) (*aggregationRule, error) {
+	matcher, err := parseMatcher(c, section)
+	if err != nil {
+		return nil, err
+	}
+	aggregationMethod := defaultAggregationMethod
+	if c.HasOption(section, "aggregationMethod") {
+		aggregationMethodS, err := c.String(section, "aggregationMethod")
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregationMethod: %v", err)
+		}
+		aggregationMethod, err = ParseAggregationMethod(aggregationMethodS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	xFilesFactor := float64(defaultXFilesFactor)
+	if c.HasOption(section, "xFilesFactor") {
+		xFilesFactor, err = c.Float(section, "xFilesFactor")
+		if err != nil {
+			return nil, fmt.Errorf("invalid xFilesFactor: %v", err)
+		}
+		if xFilesFactor < 0 || xFilesFactor > 1 {
+			return nil, fmt.Errorf("xFilesFactor %v must be between 0 and 1", xFilesFactor)
+		}
+	}
+	return &aggregationRule{section, matcher, aggregationMethod, float32(xFilesFactor)}, nil
+}
+
+/*
+	Apply the checks Whisper makes when creating a file. Taken in order of
+	precision, each archive must have a coarser precision that is divisible
+	by the previous one, cover a longer period, and the previous archive
+	must hold enough points to consolidate into one point of the next.
+*/
+func validateRetentions(retentions whisper.Retentions) error {
+	if len(retentions) == 0 {
+		return fmt.Errorf("no archives defined")
+	}
+	sorted := make([]*whisper.Retention, len(retentions))
+	copy(sorted, retentions)
+	sort.Sort(retentionsByPrecision(sorted))
+	for i, retention := range sorted {
+		if retention.SecondsPerPoint() <= 0 || retention.NumberOfPoints() <= 0 {
+			return fmt.Errorf("archive %v has no points", i)
+		}
+		if i == 0 {
+			continue
+		}
+		previous := sorted[i-1]
+		if retention.SecondsPerPoint() == previous.SecondsPerPoint() {
+			return fmt.Errorf("archives %v and %v have the same precision", i-1, i)
+		}
+		if retention.SecondsPerPoint()%previous.SecondsPerPoint() != 0 {
+			return fmt.Errorf("precision %vs is not divisible by %vs", retention.SecondsPerPoint(), previous.SecondsPerPoint())
+		}
+		if retention.MaxRetention() <= previous.MaxRetention() {
+			return fmt.Errorf("archive %v must cover a longer period than archive %v", i, i-1)
+		}
+		if previous.NumberOfPoints() < retention.SecondsPerPoint()/previous.SecondsPerPoint() {
+			return fmt.Errorf("archive %v does not have enough points to consolidate into archive %v", i-1, i)
+		}
+	}
+	return nil
+}
+
+type retentionsByPrecision []*whisper.Retention
+
+func (r retentionsByPrecision) Len() int      { return len(r) }
+func (r retentionsByPrecision) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r retentionsByPrecision) Less(i, j int) bool {
+	return r[i].SecondsPerPoint() < r[j].SecondsPerPoint()
+}
+
+/*
+	Describe the rules that were added, removed or changed in next.
+*/
+func (rules *storageRules) changes(next *storageRules) []string {
+	var changes []string
+	changes = append(changes, ruleChanges("schema", rules.describeSchemas(), next.describeSchemas())...)
+	changes = append(changes, ruleChanges("aggregation", rules.describeAggregations(), next.describeAggregations())...)
+	return changes
+}
+
+func (rules *storageRules) describeSchemas() map[string]string {
+	result := make(map[string]string, len(rules.schemas))
+	for _, rule := range rules.schemas {
+		result[rule.name] = fmt.Sprintf("%v, retentions = %v", rule.storageMatcher, rule.retentionDefs)
+	}
+	return result
+}
+
+func (rules *storageRules) describeAggregations() map[string]string {
+	result := make(map[string]string, len(rules.aggregations))
+	for _, rule := range rules.aggregations {
+		result[rule.name] = fmt.Sprintf("%v, aggregationMethod = %v, xFilesFactor = %v",
+			rule.storageMatcher, aggregationMethodName(rule.aggregationMethod), rule.xFilesFactor)
+	}
+	return result
+}
+
+func ruleChanges(kind string, previous, current map[string]string) []string {
+	var changes []string
+	for name, description := range current {
+		previousDescription, found := previous[name]
+		if !found {
+			changes = append(changes, fmt.Sprintf("added %v [%v] %v", kind, name, description))
+		} else if previousDescription != description {
+			changes = append(changes, fmt.Sprintf("changed %v [%v] from %v to %v", kind, name, previousDescription, description))
+		}
+	}
+	for name, description := range previous {
+		if _, found := current[name]; !found {
+			changes = append(changes, fmt.Sprintf("removed %v [%v] %v", kind, name, description))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+/*
+	Look up an aggregation method by the name used in
+	storage-aggregation.conf; average, sum, last, max or min.
+*/
+func ParseAggregationMethod(aggregationMethod string) (whisper.AggregationMethod, error) {
 	switch aggregationMethod {
 	case "average":
 		return whisper.Average, nil
 	case "sum":
 		return whisper.Sum, nil
+	case "last":
+		return whisper.Last, nil
 	case "max":
 		return whisper.Max, nil
 	case "min":
@@ -105,3 +449,19 @@ func (resolver *fileStorageResolver) parseAggregationMethod(aggregationMethod st
 	}
 	return 0, fmt.Errorf("Invalid aggregation method '%v'", aggregationMethod)
 }
+
+func aggregationMethodName(aggregationMethod whisper.AggregationMethod) string {
+	switch aggregationMethod {
+	case whisper.Average:
+		return "average"
+	case whisper.Sum:
+		return "sum"
+	case whisper.Last:
+		return "last"
+	case whisper.Max:
+		return "max"
+	case whisper.Min:
+		return "min"
+	}
+	return fmt.Sprintf("unknown(%d)", aggregationMethod)
+}
@@ -2,7 +2,12 @@ package silicon
 
 import (
 	"github.com/robyoung/go-whisper"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFileStorageResolver(t *testing.T) {
@@ -21,3 +26,231 @@ func TestFileStorageResolver(t *testing.T) {
 		t.Fatalf("Expecting xFilesFactor to be 0,5")
 	}
 }
+
+func TestShippedStorageConfig(t *testing.T) {
+	resolver, err := NewFileStorageResolver("config/storage-schemas.conf", "config/storage-aggregation.conf")
+	if err != nil {
+		t.Fatalf("Error reading storage config: %v", err)
+	}
+	for _, expected := range []struct {
+		key               string
+		maxRetention      int
+		aggregationMethod whisper.AggregationMethod
+		xFilesFactor      float32
+	}{
+		{"carbon.agents.foo.cpuUsage", 90 * 86400, whisper.Average, 0.5},
+		{"foo.bar", 86400, whisper.Average, 0.5},
+		{"foo.latency.min", 86400, whisper.Min, 0.1},
+		{"foo.latency.max", 86400, whisper.Max, 0.1},
+		{"foo.requests.count", 86400, whisper.Sum, 0},
+	} {
+		retentions, aggregationMethod, xFilesFactor, err := resolver.Find(expected.key)
+		if err != nil {
+			t.Fatalf("Failed to find %v: %v", expected.key, err)
+		}
+		if len(retentions) != 1 || retentions[0].SecondsPerPoint() != 60 || retentions[0].MaxRetention() != expected.maxRetention {
+			t.Errorf("Expecting %v to keep 60s points for %vs", expected.key, expected.maxRetention)
+		}
+		if aggregationMethod != expected.aggregationMethod || xFilesFactor != expected.xFilesFactor {
+			t.Errorf("Expecting %v to aggregate with %v %v, received %v %v", expected.key,
+				expected.aggregationMethod, expected.xFilesFactor, aggregationMethod, xFilesFactor)
+		}
+	}
+}
+
+func TestFileStorageResolverAggregationDefaults(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resolver")
+	defer os.RemoveAll(dir)
+	aggregation := "[last]\npattern = \\.last$\naggregationMethod = last\n" +
+		"[factor_only]\npattern = \\.factor$\nxFilesFactor = 0.2\n" +
+		"[method_only]\npattern = \\.sum$\naggregationMethod = sum\n"
+	resolver, err := NewFileStorageResolver(writeStorageConfig(t, dir, testSchemas, aggregation))
+	if err != nil {
+		t.Fatalf("Error reading storage config: %v", err)
+	}
+	for key, expected := range map[string]struct {
+		aggregationMethod whisper.AggregationMethod
+		xFilesFactor      float32
+	}{
+		"foo.last":      {whisper.Last, 0.5},
+		"foo.factor":    {whisper.Average, 0.2},
+		"foo.sum":       {whisper.Sum, 0.5},
+		"foo.unmatched": {whisper.Average, 0.5},
+	} {
+		_, aggregationMethod, xFilesFactor, err := resolver.Find(key)
+		if err != nil {
+			t.Fatalf("Failed to find %v: %v", key, err)
+		}
+		if aggregationMethod != expected.aggregationMethod || xFilesFactor != expected.xFilesFactor {
+			t.Errorf("Expecting %v to aggregate with %v %v, received %v %v", key,
+				expected.aggregationMethod, expected.xFilesFactor, aggregationMethod, xFilesFactor)
+		}
+	}
+}
+
+func TestFileStorageResolverTags(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resolver")
+	defer os.RemoveAll(dir)
+	schemas := "[web]\npattern = ^disk\\.\ntags = host=^web-\\d+$;dc=eu\nretentions = 10s:1d\n" + testSchemas
+	aggregation := "[count]\npattern = \\.count$\naggregationMethod = sum\n" + testAggregation
+	resolver, err := NewFileStorageResolver(writeStorageConfig(t, dir, schemas, aggregation))
+	if err != nil {
+		t.Fatalf("Error reading storage config: %v", err)
+	}
+	for key, secondsPerPoint := range map[string]int{
+		"disk.used;dc=eu;host=web-1":     10,
+		"disk.used;dc=us;host=web-1":     60,
+		"disk.used;dc=eu;host=db-1":      60,
+		"disk.used;host=web-1":           60,
+		"disk.used":                      60,
+		"cpu.used;dc=eu;host=web-1":      60,
+		"disk.used;dc=eu;host=web-1;x=y": 10,
+	} {
+		retentions, _, _, err := resolver.Find(key)
+		if err != nil {
+			t.Fatalf("Failed to find %v: %v", key, err)
+		}
+		if retentions[0].SecondsPerPoint() != secondsPerPoint {
+			t.Errorf("Expecting %v to have %vs points, received %v", key, secondsPerPoint, retentions[0].SecondsPerPoint())
+		}
+	}
+	// the pattern is matched against the name of a tagged series
+	if _, aggregationMethod, _, _ := resolver.Find("requests.count;host=a"); aggregationMethod != whisper.Sum {
+		t.Errorf("Expecting the pattern to match the name, received %v", aggregationMethod)
+	}
+}
+
+func TestParseAggregationMethod(t *testing.T) {
+	for _, name := range []string{"average", "sum", "last", "max", "min"} {
+		aggregationMethod, err := ParseAggregationMethod(name)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", name, err)
+		}
+		if aggregationMethodName(aggregationMethod) != name {
+			t.Errorf("Expecting %v to round trip, received %v", name, aggregationMethodName(aggregationMethod))
+		}
+	}
+	if _, err := ParseAggregationMethod("median"); err == nil {
+		t.Errorf("Expecting median to be rejected")
+	}
+}
+
+const (
+	testSchemas     = "[default]\npattern = .*\nretentions = 60s:1d\n"
+	testAggregation = "[default]\npattern = .*\nxFilesFactor = 0.5\naggregationMethod = average\n"
+)
+
+func writeStorageConfig(t *testing.T, dir, schemas, aggregation string) (string, string) {
+	schemasPath := path.Join(dir, "storage-schemas.conf")
+	aggregationPath := path.Join(dir, "storage-aggregation.conf")
+	if err := ioutil.WriteFile(schemasPath, []byte(schemas), 0644); err != nil {
+		t.Fatalf("Failed to write schemas: %v", err)
+	}
+	if err := ioutil.WriteFile(aggregationPath, []byte(aggregation), 0644); err != nil {
+		t.Fatalf("Failed to write aggregation: %v", err)
+	}
+	return schemasPath, aggregationPath
+}
+
+func TestFileStorageResolverReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resolver")
+	defer os.RemoveAll(dir)
+	resolver, err := NewFileStorageResolver(writeStorageConfig(t, dir, testSchemas, testAggregation))
+	if err != nil {
+		t.Fatalf("Error reading storage schemas: %v", err)
+	}
+
+	writeStorageConfig(t, dir, "[default]\npattern = (\nretentions = 60s:1d\n", testAggregation)
+	if err := resolver.Reload(); err == nil {
+		t.Fatalf("Expecting an invalid pattern to fail to reload")
+	}
+	if _, _, _, err := resolver.Find("foo.bar"); err != nil {
+		t.Fatalf("Expecting the old rules to be kept: %v", err)
+	}
+	if modified := latestModified(resolver.schemasPath, resolver.aggregationPath); !resolver.modified.Equal(modified) {
+		t.Fatalf("Expecting a failed reload to record the attempted modification time %v, received %v", modified, resolver.modified)
+	}
+
+	writeStorageConfig(t, dir, testSchemas, "[default]\npattern = .*\nxFilesFactor = 0.1\naggregationMethod = max\n")
+	if err := resolver.Reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	_, aggregationMethod, xFilesFactor, _ := resolver.Find("foo.bar")
+	if aggregationMethod != whisper.Max || xFilesFactor != 0.1 {
+		t.Fatalf("Expecting the new rules to be used, received %v %v", aggregationMethod, xFilesFactor)
+	}
+}
+
+func TestFileStorageResolverSortsRetentions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resolver")
+	defer os.RemoveAll(dir)
+	resolver, err := NewFileStorageResolver(writeStorageConfig(t, dir, "[default]\npattern = .*\nretentions = 1h:7d,1m:1d\n", testAggregation))
+	if err != nil {
+		t.Fatalf("Error reading storage schemas: %v", err)
+	}
+	retentions, _, _, _ := resolver.Find("foo.bar")
+	if len(retentions) != 2 || retentions[0].SecondsPerPoint() != 60 || retentions[1].SecondsPerPoint() != 3600 {
+		t.Fatalf("Expecting retentions in order of precision, received %v", retentions)
+	}
+}
+
+func TestFileStorageResolverWatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resolver")
+	defer os.RemoveAll(dir)
+	resolver, err := NewFileStorageResolver(writeStorageConfig(t, dir, testSchemas, testAggregation))
+	if err != nil {
+		t.Fatalf("Error reading storage schemas: %v", err)
+	}
+	hup := make(chan os.Signal)
+	stop := make(chan bool)
+	defer close(stop)
+	go resolver.Watch(time.Hour, hup, stop)
+
+	writeStorageConfig(t, dir, testSchemas, "[default]\npattern = .*\nxFilesFactor = 0.1\naggregationMethod = sum\n")
+	hup <- os.Interrupt
+	for i := 0; i < 100; i++ {
+		if _, aggregationMethod, _, _ := resolver.Find("foo.bar"); aggregationMethod == whisper.Sum {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expecting a signal to reload the rules")
+}
+
+func TestFileStorageResolverReportsEveryError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resolver")
+	defer os.RemoveAll(dir)
+	schemas := "[bad_pattern]\npattern = (\nretentions = 60s:1d\n" +
+		"[not_divisible]\npattern = .*\nretentions = 60s:1d,90s:7d\n"
+	aggregation := "[bad_method]\npattern = .*\nxFilesFactor = 0.5\naggregationMethod = median\n" +
+		"[bad_factor]\npattern = .*\nxFilesFactor = 2\naggregationMethod = sum\n"
+	_, err := NewFileStorageResolver(writeStorageConfig(t, dir, schemas, aggregation))
+	if err == nil {
+		t.Fatalf("Expecting invalid rules to fail to load")
+	}
+	for _, section := range []string{"[bad_pattern]", "[not_divisible]", "[bad_method]", "[bad_factor]"} {
+		if !strings.Contains(err.Error(), section) {
+			t.Errorf("Expecting an error for %v, received %v", section, err)
+		}
+	}
+}
+
+func TestValidateRetentions(t *testing.T) {
+	for defs, valid := range map[string]bool{
+		"60s:1d":              true,
+		"10s:6h,1m:7d,10m:1y": true,
+		"1m:7d,10s:6h":        true,
+		"60s:1d,90s:7d":       false,
+		"60s:1d,60s:7d":       false,
+		"60s:7d,5m:1d":        false,
+		"60s:2,5m:1y":         false,
+	} {
+		retentions, err := whisper.ParseRetentionDefs(defs)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", defs, err)
+		}
+		if err := validateRetentions(retentions); (err == nil) != valid {
+			t.Errorf("Expecting %v to be valid %v, received %v", defs, valid, err)
+		}
+	}
+}
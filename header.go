@@ -0,0 +1,69 @@
+package silicon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/robyoung/go-whisper"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	whisperMetadataSize    = 16
+	whisperArchiveInfoSize = 12
+)
+
+/*
+	The metadata stored at the start of a Whisper file. This is read
+	directly so that files can be inspected without opening them for write.
+*/
+type whisperHeader struct {
+	aggregationMethod whisper.AggregationMethod
+	maxRetention      int
+	xFilesFactor      float32
+	archives          []whisperArchiveInfo
+}
+
+type whisperArchiveInfo struct {
+	offset          int
+	secondsPerPoint int
+	points          int
+}
+
+func readWhisperHeader(path string) (*whisperHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	metadata := make([]byte, whisperMetadataSize)
+	if _, err := io.ReadFull(file, metadata); err != nil {
+		return nil, fmt.Errorf("Invalid Whisper header in %v: %v", path, err)
+	}
+	header := new(whisperHeader)
+	header.aggregationMethod = whisper.AggregationMethod(binary.BigEndian.Uint32(metadata[0:4]))
+	header.maxRetention = int(binary.BigEndian.Uint32(metadata[4:8]))
+	header.xFilesFactor = math.Float32frombits(binary.BigEndian.Uint32(metadata[8:12]))
+	archiveCount := int(binary.BigEndian.Uint32(metadata[12:16]))
+	if archiveCount > 1024 {
+		return nil, fmt.Errorf("Invalid Whisper header in %v: %v archives", path, archiveCount)
+	}
+
+	archives := make([]byte, archiveCount*whisperArchiveInfoSize)
+	if _, err := io.ReadFull(file, archives); err != nil {
+		return nil, fmt.Errorf("Invalid Whisper header in %v: %v", path, err)
+	}
+	header.archives = make([]whisperArchiveInfo, archiveCount)
+	for i := range header.archives {
+		info := archives[i*whisperArchiveInfoSize:]
+		header.archives[i] = whisperArchiveInfo{
+			int(binary.BigEndian.Uint32(info[0:4])),
+			int(binary.BigEndian.Uint32(info[4:8])),
+			int(binary.BigEndian.Uint32(info[8:12])),
+		}
+	}
+
+	return header, nil
+}
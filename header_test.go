@@ -0,0 +1,46 @@
+package silicon
+
+import (
+	"encoding/binary"
+	"github.com/robyoung/go-whisper"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestReadWhisperHeader(t *testing.T) {
+	file, err := ioutil.TempFile("", "header")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	fields := []uint32{uint32(whisper.Max), 1800, math.Float32bits(0.5), 2, 40, 1, 300, 3640, 60, 30}
+	binary.Write(file, binary.BigEndian, fields)
+	file.Close()
+
+	header, err := readWhisperHeader(file.Name())
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if header.aggregationMethod != whisper.Max || header.maxRetention != 1800 || header.xFilesFactor != 0.5 {
+		t.Fatalf("Invalid metadata %v", header)
+	}
+	if len(header.archives) != 2 || header.archives[1] != (whisperArchiveInfo{3640, 60, 30}) {
+		t.Fatalf("Invalid archives %v", header.archives)
+	}
+}
+
+func TestReadWhisperHeaderTruncated(t *testing.T) {
+	file, err := ioutil.TempFile("", "header")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	binary.Write(file, binary.BigEndian, []uint32{1, 1800, 0, 2})
+	file.Close()
+
+	if _, err := readWhisperHeader(file.Name()); err == nil {
+		t.Fatalf("Expecting an error for a truncated header")
+	}
+}
@@ -6,12 +6,57 @@ import (
 
 /*
   Describes a metric, this is made up of a dot separated key (eg. machine.stats.cpu), a unix timestamp and a numeric value.
+  Tagged series have keys of the form name;tag1=value1;tag2=value2.
 */
 type Metric struct {
 	key string
 	DataPoint
 }
 
+/*
+  Create a metric. A tagged key is validated and put in its canonical form, with the tags sorted.
+*/
+func NewMetric(key string, value float64, timestamp int64) (*Metric, error) {
+	key, err := canonicalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Metric{key, DataPoint{value, timestamp}}, nil
+}
+
+/*
+  Create a metric for a tagged series from its name and tags, with no tags this is the same as NewMetric.
+*/
+func NewTaggedMetric(name string, tags map[string]string, value float64, timestamp int64) (*Metric, error) {
+	return NewMetric(formatTaggedKey(name, tags), value, timestamp)
+}
+
+/*
+  The key of the metric, including any tags.
+*/
+func (metric *Metric) Key() string {
+	return metric.key
+}
+
+/*
+  The name of the series without any tags, for untagged metrics this is the key.
+*/
+func (metric *Metric) Name() string {
+	name, _, _ := parseTaggedKey(metric.key)
+	return name
+}
+
+/*
+  The tags of the series, empty for untagged metrics. Changing the map does not change the metric.
+*/
+func (metric *Metric) Tags() map[string]string {
+	_, tags, err := parseTaggedKey(metric.key)
+	if err != nil {
+		return map[string]string{}
+	}
+	return tags
+}
+
 func (metric *Metric) String() string {
 	return fmt.Sprintf("Metric{key: %v, value: %v, timestamp: %v}", metric.key, metric.value, metric.timestamp)
 }
@@ -21,5 +66,20 @@ func (metric *Metric) String() string {
 */
 type DataPoint struct {
 	value     float64
-	timestamp int
+	timestamp int64
+}
+
+/*
+  Create a data point, the timestamp is in seconds since the unix epoch.
+*/
+func NewDataPoint(value float64, timestamp int64) DataPoint {
+	return DataPoint{value, timestamp}
+}
+
+func (point DataPoint) Value() float64 {
+	return point.value
+}
+
+func (point DataPoint) Timestamp() int64 {
+	return point.timestamp
 }
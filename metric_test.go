@@ -0,0 +1,71 @@
+package silicon_test
+
+import (
+	"github.com/robyoung/go-silicon"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a CacheSink written against the public API only
+type collectingSink struct {
+	lock   sync.Mutex
+	points map[string][]silicon.DataPoint
+}
+
+func (sink *collectingSink) Send(key string, points []silicon.DataPoint) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.points[key] = append(sink.points[key], points...)
+}
+
+func (sink *collectingSink) get(key string) []silicon.DataPoint {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.points[key]
+}
+
+func TestNewMetric(t *testing.T) {
+	metric, err := silicon.NewMetric("disk.used;host=a;dc=eu", 1.5, 1234)
+	if err != nil {
+		t.Fatalf("Failed to create metric: %v", err)
+	}
+	if metric.Key() != "disk.used;dc=eu;host=a" || metric.Name() != "disk.used" {
+		t.Fatalf("Expecting the canonical key, received %v", metric)
+	}
+	if !reflect.DeepEqual(metric.Tags(), map[string]string{"dc": "eu", "host": "a"}) {
+		t.Fatalf("Invalid tags %v", metric.Tags())
+	}
+	if metric.Value() != 1.5 || metric.Timestamp() != 1234 {
+		t.Fatalf("Invalid data point %v", metric)
+	}
+	if _, err := silicon.NewMetric("disk.used;host=", 1, 1); err == nil {
+		t.Fatalf("Expecting an invalid tag to be rejected")
+	}
+
+	tagged, err := silicon.NewTaggedMetric("disk.used", map[string]string{"host": "a", "dc": "eu"}, 1.5, 1234)
+	if err != nil || tagged.Key() != metric.Key() {
+		t.Fatalf("Expecting the same key from name and tags, received %v %v", tagged, err)
+	}
+	untagged, _ := silicon.NewTaggedMetric("disk.used", nil, 1, 1)
+	if untagged.Key() != "disk.used" || len(untagged.Tags()) != 0 {
+		t.Fatalf("Expecting no tags to give a plain key, received %v", untagged)
+	}
+}
+
+func TestMetricsThroughCache(t *testing.T) {
+	cache := silicon.NewMetricCache()
+	sink := &collectingSink{points: make(map[string][]silicon.DataPoint)}
+	bolt := silicon.NewCacheBolt(cache, sink, nil)
+	metric, _ := silicon.NewMetric("foo.bar", 2.5, 1<<40)
+	cache.Store(metric)
+	for i := 0; i < 100 && len(sink.get("foo.bar")) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	bolt.Close()
+	cache.Close()
+	if points := sink.get("foo.bar"); !reflect.DeepEqual(points, []silicon.DataPoint{silicon.NewDataPoint(2.5, 1<<40)}) {
+		t.Fatalf("Invalid points %v", points)
+	}
+}
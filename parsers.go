@@ -6,6 +6,13 @@ import (
 	"strings"
 )
 
+/*
+	The timestamp used for points sent as "N" or -1, which some senders use
+	to mean the current time. It is resolved when points are validated,
+	without a validating cache the writer rejects it.
+*/
+const nowTimestamp = -1
+
 func ParseLineMetric(line string) (*Metric, error) {
 	parts := strings.Split(line, " ")
 	if len(parts) != 3 {
@@ -15,10 +22,111 @@ func ParseLineMetric(line string) (*Metric, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Cannot parse metric, invalid value '%v'", parts[1])
 	}
+	if parts[2] == "N" {
+		parts[2] = strconv.Itoa(nowTimestamp)
+	}
 	timestamp, err := strconv.ParseInt(parts[2], 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot parse metric, invalid timestamp '%v'", parts[2])
 	}
 
-	return &Metric{parts[0], DataPoint{value, int(timestamp)}}, nil
+	key, err := canonicalKey(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse metric, %v", err)
+	}
+
+	return &Metric{key, DataPoint{value, timestamp}}, nil
+}
+
+/*
+	Format a metric in the plaintext protocol, without the newline.
+*/
+func formatLineMetric(metric *Metric) string {
+	return metric.key + " " + strconv.FormatFloat(metric.value, 'g', -1, 64) + " " + strconv.FormatInt(metric.timestamp, 10)
+}
+
+/*
+	Parse a pickled batch of metrics as sent by carbon relays and graphite
+	tooling; a list of (path, (timestamp, value)) tuples. As in carbon,
+	invalid tuples are skipped and the rest of the batch is returned along
+	with an error counting them.
+*/
+func ParsePickleMetrics(payload []byte) ([]*Metric, error) {
+	data, err := unpickle(payload)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := data.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Cannot parse pickle, expecting a list but received %T", data)
+	}
+	metrics := make([]*Metric, 0, len(items))
+	invalid := 0
+	var firstErr error
+	for _, item := range items {
+		metric, err := parsePickleMetric(item)
+		if err != nil {
+			if invalid == 0 {
+				firstErr = err
+			}
+			invalid++
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	if invalid > 0 {
+		return metrics, fmt.Errorf("Skipped %v invalid metrics, the first: %v", invalid, firstErr)
+	}
+	return metrics, nil
+}
+
+func parsePickleMetric(item interface{}) (*Metric, error) {
+	parts, ok := pickleSequence(item)
+	if !ok || len(parts) != 2 {
+		return nil, fmt.Errorf("Cannot parse metric, invalid structure '%v'", item)
+	}
+	key, ok := parts[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Cannot parse metric, invalid key '%v'", parts[0])
+	}
+	key, err := canonicalKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse metric, %v", err)
+	}
+	point, ok := pickleSequence(parts[1])
+	if !ok || len(point) != 2 {
+		return nil, fmt.Errorf("Cannot parse metric, invalid data point '%v'", parts[1])
+	}
+	timestamp, err := pickleFloat(point[0])
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse metric, invalid timestamp '%v'", point[0])
+	}
+	value, err := pickleFloat(point[1])
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse metric, invalid value '%v'", point[1])
+	}
+
+	return &Metric{key, DataPoint{value, int64(timestamp)}}, nil
+}
+
+func pickleSequence(value interface{}) ([]interface{}, bool) {
+	switch value := value.(type) {
+	case pickleTuple:
+		return value, true
+	case []interface{}:
+		return value, true
+	}
+	return nil, false
+}
+
+func pickleFloat(value interface{}) (float64, error) {
+	switch value := value.(type) {
+	case int64:
+		return float64(value), nil
+	case float64:
+		return value, nil
+	case string:
+		return strconv.ParseFloat(value, 64)
+	}
+	return 0, fmt.Errorf("Not a number '%v'", value)
 }
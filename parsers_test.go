@@ -19,3 +19,76 @@ func TestParseLineMetric(t *testing.T) {
 		t.Fatalf("Invalid metric timestamp. Expecting 74857843, received %v", metric.timestamp)
 	}
 }
+
+func TestParseLineMetricTagged(t *testing.T) {
+	metric, err := ParseLineMetric("disk.used;host=a;dc=eu 42 74857843")
+	if err != nil {
+		t.Fatalf("Failed to parse metric: %v", err)
+	}
+	if metric.key != "disk.used;dc=eu;host=a" {
+		t.Fatalf("Expecting the tags to be sorted, received %v", metric.key)
+	}
+	if _, err := ParseLineMetric("disk.used;host 42 74857843"); err == nil {
+		t.Fatalf("Expecting an invalid tag to fail")
+	}
+}
+
+func TestParseLineMetricNow(t *testing.T) {
+	for _, line := range []string{"foo.bar 42 N", "foo.bar 42 -1"} {
+		metric, err := ParseLineMetric(line)
+		if err != nil {
+			t.Fatalf("Failed to parse metric: %v", err)
+		}
+		if metric.timestamp != nowTimestamp {
+			t.Fatalf("Expecting '%v' to be parsed as now, received %v", line, metric.timestamp)
+		}
+	}
+}
+
+func TestParsePickleMetrics(t *testing.T) {
+	metrics, err := ParsePickleMetrics([]byte(picklesByProtocol[2]))
+	if err != nil {
+		t.Fatalf("Failed to parse pickle: %v", err)
+	}
+	if length := len(metrics); length != 2 {
+		t.Fatalf("Expecting 2 metrics, received %v", length)
+	}
+	if metrics[1].key != "foo.baz" || metrics[1].value != 2 || metrics[1].timestamp != 1235 {
+		t.Fatalf("Invalid metric, received %v", metrics[1])
+	}
+}
+
+func TestParsePickleMetricsStringValue(t *testing.T) {
+	// pickle.dumps([('foo.bar', (1234.0, '1.5'))], protocol=2)
+	data := "\x80\x02]q\x00X\x07\x00\x00\x00foo.barq\x01G@\x93H\x00\x00\x00\x00\x00X\x03\x00\x00\x001.5q\x02\x86q\x03\x86q\x04a."
+	metrics, err := ParsePickleMetrics([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to parse pickle: %v", err)
+	}
+	if metrics[0].value != 1.5 || metrics[0].timestamp != 1234 {
+		t.Fatalf("Invalid metric, received %v", metrics[0])
+	}
+}
+
+func TestParsePickleMetricsSkipsInvalid(t *testing.T) {
+	data, _ := pickle([]interface{}{
+		pickleTuple{"foo.bar", pickleTuple{1234, 1.5}},
+		pickleTuple{"foo.bad", 1234},
+		pickleTuple{"foo.baz", pickleTuple{1235, 2.5}},
+	})
+	metrics, err := ParsePickleMetrics(data)
+	if err == nil {
+		t.Fatalf("Expecting the invalid tuple to be reported")
+	}
+	if len(metrics) != 2 || metrics[1].key != "foo.baz" || metrics[1].value != 2.5 {
+		t.Fatalf("Expecting the metrics either side of the invalid tuple, received %v", metrics)
+	}
+}
+
+func TestParsePickleMetricsInvalid(t *testing.T) {
+	// pickle.dumps([('foo.bar', 1234)], protocol=2)
+	data := "\x80\x02]q\x00X\x07\x00\x00\x00foo.barq\x01M\xd2\x04\x86q\x02a."
+	if _, err := ParsePickleMetrics([]byte(data)); err == nil {
+		t.Fatalf("Expecting an error for a metric without a data point")
+	}
+}
@@ -0,0 +1,601 @@
+package silicon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+	A minimal, safe unpickler for the subset of the Python pickle protocol
+	used by carbon. Only the opcodes needed to build lists, tuples, dicts,
+	strings and numbers are accepted, anything that could import or call Python
+	objects (GLOBAL, REDUCE, BUILD, INST, OBJ...) is rejected.
+*/
+type unpickler struct {
+	reader *bufio.Reader
+	stack  []interface{}
+	marks  []int
+	memo   map[int]interface{}
+}
+
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opPopMark        = '1'
+	opDup            = '2'
+	opFloat          = 'F'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opLong           = 'L'
+	opBinInt2        = 'M'
+	opNone           = 'N'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opAppend         = 'a'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opGet            = 'g'
+	opList           = 'l'
+	opEmptyList      = ']'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opTuple          = 't'
+	opEmptyTuple     = ')'
+	opEmptyDict      = '}'
+	opDict           = 'd'
+	opSetItem        = 's'
+	opSetItems       = 'u'
+	opAppends        = 'e'
+	opBinFloat       = 'G'
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+	opProto          = 0x80
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opLong1          = 0x8a
+	opLong4          = 0x8b
+	opShortBinUni    = 0x8c
+	opBinUnicode8    = 0x8d
+	opBinBytes8      = 0x8e
+	opMemoize        = 0x94
+	opFrame          = 0x95
+)
+
+/*
+	Decode a single pickled value from data. Lists are returned as
+	[]interface{}, tuples as pickleTuple, dicts as map[string]interface{},
+	strings and bytes as string, integers as int64 and floats as float64.
+*/
+func unpickle(data []byte) (interface{}, error) {
+	return newUnpickler(bytes.NewReader(data)).load()
+}
+
+// tuples are kept distinct from lists so callers can be strict if they wish
+type pickleTuple []interface{}
+
+func newUnpickler(reader io.Reader) *unpickler {
+	u := new(unpickler)
+	u.reader = bufio.NewReader(reader)
+	u.memo = make(map[int]interface{})
+	return u
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("Pickle truncated: %v", err)
+		}
+		switch op {
+		case opStop:
+			if len(u.stack) != 1 {
+				return nil, fmt.Errorf("Pickle stack has %v items at STOP", len(u.stack))
+			}
+			return u.stack[0], nil
+		case opProto:
+			if _, err = u.reader.ReadByte(); err != nil {
+				return nil, err
+			}
+		case opFrame:
+			_, err = u.readN(8)
+		case opMark:
+			u.marks = append(u.marks, len(u.stack))
+		case opPop:
+			// as in Python, popping with nothing pushed since the MARK removes it
+			if len(u.marks) > 0 && u.marks[len(u.marks)-1] == len(u.stack) {
+				u.marks = u.marks[:len(u.marks)-1]
+			} else {
+				_, err = u.pop()
+			}
+		case opPopMark:
+			_, err = u.popMark()
+		case opDup:
+			var value interface{}
+			if value, err = u.top(); err == nil {
+				u.push(value)
+			}
+		case opNone:
+			u.push(nil)
+		case opNewTrue:
+			u.push(true)
+		case opNewFalse:
+			u.push(false)
+		case opInt:
+			err = u.loadInt()
+		case opLong:
+			err = u.loadLong()
+		case opBinInt:
+			var b []byte
+			if b, err = u.readN(4); err == nil {
+				u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case opBinInt1:
+			var b byte
+			if b, err = u.reader.ReadByte(); err == nil {
+				u.push(int64(b))
+			}
+		case opBinInt2:
+			var b []byte
+			if b, err = u.readN(2); err == nil {
+				u.push(int64(binary.LittleEndian.Uint16(b)))
+			}
+		case opLong1:
+			var n byte
+			if n, err = u.reader.ReadByte(); err == nil {
+				err = u.loadBinLong(int(n))
+			}
+		case opLong4:
+			var n int
+			if n, err = u.readLength(4); err == nil {
+				err = u.loadBinLong(n)
+			}
+		case opFloat:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var value float64
+				if value, err = strconv.ParseFloat(line, 64); err == nil {
+					u.push(value)
+				}
+			}
+		case opBinFloat:
+			var b []byte
+			if b, err = u.readN(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case opString:
+			err = u.loadString()
+		case opUnicode:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case opShortBinString, opShortBinBytes, opShortBinUni:
+			err = u.loadBinString(1)
+		case opBinString, opBinBytes, opBinUnicode:
+			err = u.loadBinString(4)
+		case opBinUnicode8, opBinBytes8:
+			err = u.loadBinString(8)
+		case opEmptyList:
+			u.push([]interface{}{})
+		case opEmptyTuple:
+			u.push(pickleTuple{})
+		case opList:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case opTuple:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(pickleTuple(items))
+			}
+		case opTuple1, opTuple2, opTuple3:
+			err = u.loadTupleN(int(op-opTuple1) + 1)
+		case opEmptyDict:
+			u.push(make(map[string]interface{}))
+		case opDict:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				dict := make(map[string]interface{})
+				if err = setItems(dict, items); err == nil {
+					u.push(dict)
+				}
+			}
+		case opSetItem:
+			var items []interface{}
+			if len(u.stack) < 2 {
+				err = fmt.Errorf("stack underflow")
+			} else {
+				items = u.stack[len(u.stack)-2:]
+				u.stack = u.stack[:len(u.stack)-2]
+				err = u.update(items)
+			}
+		case opSetItems:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.update(items)
+			}
+		case opAppend:
+			var value interface{}
+			if value, err = u.pop(); err == nil {
+				err = u.extend([]interface{}{value})
+			}
+		case opAppends:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.extend(items)
+			}
+		case opPut:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var index int
+				if index, err = strconv.Atoi(line); err == nil {
+					err = u.put(index)
+				}
+			}
+		case opBinPut:
+			var b byte
+			if b, err = u.reader.ReadByte(); err == nil {
+				err = u.put(int(b))
+			}
+		case opLongBinPut:
+			var index int
+			if index, err = u.readLength(4); err == nil {
+				err = u.put(index)
+			}
+		case opMemoize:
+			err = u.put(len(u.memo))
+		case opGet:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var index int
+				if index, err = strconv.Atoi(line); err == nil {
+					err = u.get(index)
+				}
+			}
+		case opBinGet:
+			var b byte
+			if b, err = u.reader.ReadByte(); err == nil {
+				err = u.get(int(b))
+			}
+		case opLongBinGet:
+			var index int
+			if index, err = u.readLength(4); err == nil {
+				err = u.get(index)
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported pickle opcode 0x%02x", op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pickle: %v", err)
+		}
+	}
+}
+
+func (u *unpickler) push(value interface{}) {
+	u.stack = append(u.stack, value)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	value, err := u.top()
+	if err == nil {
+		u.stack = u.stack[:len(u.stack)-1]
+	}
+	return value, err
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, fmt.Errorf("mark not found")
+	}
+	mark := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	if mark > len(u.stack) {
+		return nil, fmt.Errorf("mark beyond the top of the stack")
+	}
+	items := make([]interface{}, len(u.stack)-mark)
+	copy(items, u.stack[mark:])
+	u.stack = u.stack[:mark]
+	return items, nil
+}
+
+func (u *unpickler) extend(items []interface{}) error {
+	if len(u.stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	list, ok := u.stack[len(u.stack)-1].([]interface{})
+	if !ok {
+		return fmt.Errorf("append to non list %T", u.stack[len(u.stack)-1])
+	}
+	u.stack[len(u.stack)-1] = append(list, items...)
+	return nil
+}
+
+func (u *unpickler) update(items []interface{}) error {
+	if len(u.stack) == 0 {
+		return fmt.Errorf("stack underflow")
+	}
+	dict, ok := u.stack[len(u.stack)-1].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("set item on non dict %T", u.stack[len(u.stack)-1])
+	}
+	return setItems(dict, items)
+}
+
+func setItems(dict map[string]interface{}, items []interface{}) error {
+	if len(items)%2 != 0 {
+		return fmt.Errorf("odd number of dict items")
+	}
+	for i := 0; i < len(items); i += 2 {
+		key, ok := items[i].(string)
+		if !ok {
+			return fmt.Errorf("unsupported dict key %T", items[i])
+		}
+		dict[key] = items[i+1]
+	}
+	return nil
+}
+
+func (u *unpickler) put(index int) error {
+	value, err := u.top()
+	if err == nil {
+		u.memo[index] = value
+	}
+	return err
+}
+
+func (u *unpickler) get(index int) error {
+	value, ok := u.memo[index]
+	if !ok {
+		return fmt.Errorf("memo key %v not found", index)
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadTupleN(n int) error {
+	if len(u.stack) < n {
+		return fmt.Errorf("stack underflow")
+	}
+	items := make(pickleTuple, n)
+	copy(items, u.stack[len(u.stack)-n:])
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(items)
+	return nil
+}
+
+func (u *unpickler) loadInt() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	// protocol 0 encodes booleans as I01 and I00
+	switch line {
+	case "01":
+		u.push(true)
+		return nil
+	case "00":
+		u.push(false)
+		return nil
+	}
+	value, err := strconv.ParseInt(line, 10, 64)
+	if err != nil {
+		return err
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadLong() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+	if err != nil {
+		return err
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadBinLong(n int) error {
+	b, err := u.readN(n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		u.push(int64(0))
+		return nil
+	}
+	// little endian two's complement
+	reversed := make([]byte, n)
+	for i := range b {
+		reversed[n-1-i] = b[i]
+	}
+	value := new(big.Int).SetBytes(reversed)
+	if b[n-1]&0x80 != 0 {
+		value.Sub(value, new(big.Int).Lsh(big.NewInt(1), uint(n*8)))
+	}
+	if !value.IsInt64() {
+		return fmt.Errorf("long out of range")
+	}
+	u.push(value.Int64())
+	return nil
+}
+
+func (u *unpickler) loadString() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	if len(line) < 2 || line[0] != line[len(line)-1] || (line[0] != '\'' && line[0] != '"') {
+		return fmt.Errorf("insecure string pickle")
+	}
+	value, err := strconv.Unquote("\"" + strings.Replace(line[1:len(line)-1], "\"", "\\\"", -1) + "\"")
+	if err != nil {
+		// fall back to the raw contents, carbon keys never need escaping
+		value = line[1 : len(line)-1]
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadBinString(lengthSize int) error {
+	n, err := u.readLength(lengthSize)
+	if err != nil {
+		return err
+	}
+	b, err := u.readN(n)
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) readLength(size int) (int, error) {
+	b, err := u.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch size {
+	case 1:
+		n = uint64(b[0])
+	case 4:
+		n = uint64(binary.LittleEndian.Uint32(b))
+	case 8:
+		n = binary.LittleEndian.Uint64(b)
+	}
+	if n > maxPickleLength {
+		return 0, fmt.Errorf("length %v too large", n)
+	}
+	return int(n), nil
+}
+
+func (u *unpickler) readN(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(u.reader, b)
+	return b, err
+}
+
+func (u *unpickler) readLine() (string, error) {
+	line, err := u.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+/*
+	Encode a value using pickle protocol 2. Supports the same types that
+	unpickle produces plus int and bool.
+*/
+func pickle(value interface{}) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	buffer.Write([]byte{opProto, 2})
+	if err := pickleValue(buffer, value); err != nil {
+		return nil, err
+	}
+	buffer.WriteByte(opStop)
+	return buffer.Bytes(), nil
+}
+
+func pickleValue(buffer *bytes.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		buffer.WriteByte(opNone)
+	case bool:
+		if value {
+			buffer.WriteByte(opNewTrue)
+		} else {
+			buffer.WriteByte(opNewFalse)
+		}
+	case int:
+		pickleInt(buffer, int64(value))
+	case int64:
+		pickleInt(buffer, value)
+	case float32:
+		pickleFloat64(buffer, float64(value))
+	case float64:
+		pickleFloat64(buffer, value)
+	case string:
+		buffer.WriteByte(opBinUnicode)
+		binary.Write(buffer, binary.LittleEndian, uint32(len(value)))
+		buffer.WriteString(value)
+	case pickleTuple:
+		buffer.WriteByte(opMark)
+		for _, item := range value {
+			if err := pickleValue(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(opTuple)
+	case []interface{}:
+		buffer.WriteByte(opEmptyList)
+		if len(value) > 0 {
+			buffer.WriteByte(opMark)
+			for _, item := range value {
+				if err := pickleValue(buffer, item); err != nil {
+					return err
+				}
+			}
+			buffer.WriteByte(opAppends)
+		}
+	case map[string]interface{}:
+		buffer.WriteByte(opEmptyDict)
+		if len(value) > 0 {
+			buffer.WriteByte(opMark)
+			for key, item := range value {
+				pickleValue(buffer, key)
+				if err := pickleValue(buffer, item); err != nil {
+					return err
+				}
+			}
+			buffer.WriteByte(opSetItems)
+		}
+	default:
+		return fmt.Errorf("Cannot pickle %T", value)
+	}
+	return nil
+}
+
+func pickleInt(buffer *bytes.Buffer, value int64) {
+	if value >= math.MinInt32 && value <= math.MaxInt32 {
+		buffer.WriteByte(opBinInt)
+		binary.Write(buffer, binary.LittleEndian, int32(value))
+	} else {
+		buffer.WriteByte(opLong1)
+		buffer.WriteByte(8)
+		binary.Write(buffer, binary.LittleEndian, value)
+	}
+}
+
+func pickleFloat64(buffer *bytes.Buffer, value float64) {
+	buffer.WriteByte(opBinFloat)
+	binary.Write(buffer, binary.BigEndian, value)
+}
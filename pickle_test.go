@@ -0,0 +1,83 @@
+package silicon
+
+import (
+	"testing"
+)
+
+var picklesByProtocol = map[int]string{
+	0: "(lp0\n(Vfoo.bar\np1\n(I1234\nF1.5\ntp2\ntp3\na(Vfoo.baz\np4\n(I1235\nI2\ntp5\ntp6\na.",
+	1: "]q\x00((X\x07\x00\x00\x00foo.barq\x01(M\xd2\x04G?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(X\x07\x00\x00\x00foo.bazq\x04(M\xd3\x04K\x02tq\x05tq\x06e.",
+	2: "\x80\x02]q\x00(X\x07\x00\x00\x00foo.barq\x01M\xd2\x04G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x07\x00\x00\x00foo.bazq\x04M\xd3\x04K\x02\x86q\x05\x86q\x06e.",
+	4: "\x80\x04\x952\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x07foo.bar\x94M\xd2\x04G?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x07foo.baz\x94M\xd3\x04K\x02\x86\x94\x86\x94e.",
+}
+
+func TestUnpickle(t *testing.T) {
+	for protocol, data := range picklesByProtocol {
+		result, err := unpickle([]byte(data))
+		if err != nil {
+			t.Fatalf("Failed to unpickle protocol %v: %v", protocol, err)
+		}
+		items, ok := result.([]interface{})
+		if !ok || len(items) != 2 {
+			t.Fatalf("Expecting a list of two items for protocol %v, received %v", protocol, result)
+		}
+		item := items[0].(pickleTuple)
+		if item[0] != "foo.bar" {
+			t.Fatalf("Expecting key foo.bar for protocol %v, received %v", protocol, item[0])
+		}
+		point := item[1].(pickleTuple)
+		if point[0] != int64(1234) || point[1] != 1.5 {
+			t.Fatalf("Expecting point (1234, 1.5) for protocol %v, received %v", protocol, point)
+		}
+	}
+}
+
+func TestUnpickleRejectsGlobals(t *testing.T) {
+	// pickle.dumps(os.system, protocol=2)
+	_, err := unpickle([]byte("\x80\x02cposix\nsystem\nq\x00."))
+	if err == nil {
+		t.Fatalf("Expecting GLOBAL opcode to be rejected")
+	}
+}
+
+func TestUnpickleTruncated(t *testing.T) {
+	data := picklesByProtocol[2]
+	_, err := unpickle([]byte(data[:len(data)-5]))
+	if err == nil {
+		t.Fatalf("Expecting truncated pickle to fail")
+	}
+}
+
+func TestUnpickleMarkPopped(t *testing.T) {
+	for _, op := range []string{"t", "l", "e"} {
+		// POP removes the MARK, leaving only the int for the op to collect
+		_, err := unpickle([]byte("K\x01(0" + op + "."))
+		if err == nil {
+			t.Errorf("Expecting %v after a popped MARK to fail", op)
+		}
+	}
+	// items popped from below the MARK
+	_, err := unpickle([]byte("K\x01K\x02(00t."))
+	if err == nil {
+		t.Errorf("Expecting a MARK beyond the stack to fail")
+	}
+}
+
+func TestPickleRoundTrip(t *testing.T) {
+	data, err := pickle(map[string]interface{}{
+		"datapoints": []interface{}{pickleTuple{1234, 1.5}},
+		"error":      nil,
+	})
+	if err != nil {
+		t.Fatalf("Failed to pickle: %v", err)
+	}
+	result, err := unpickle(data)
+	if err != nil {
+		t.Fatalf("Failed to unpickle: %v", err)
+	}
+	dict := result.(map[string]interface{})
+	point := dict["datapoints"].([]interface{})[0].(pickleTuple)
+	if point[0] != int64(1234) || point[1] != 1.5 || dict["error"] != nil {
+		t.Fatalf("Invalid round trip %v", dict)
+	}
+}
@@ -0,0 +1,83 @@
+package silicon
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	A token bucket rate limiter. Tokens are added continuously at rate per
+	second up to capacity.
+*/
+type tokenBucket struct {
+	lock     sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity, rate float64) *tokenBucket {
+	return &tokenBucket{capacity: capacity, tokens: capacity, rate: rate, last: time.Now()}
+}
+
+func (bucket *tokenBucket) refill() {
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.capacity {
+		bucket.tokens = bucket.capacity
+	}
+	bucket.last = now
+}
+
+/*
+	Take a token if one is available without waiting.
+*/
+func (bucket *tokenBucket) take() bool {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	bucket.refill()
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+	return false
+}
+
+/*
+	Take a token, waiting until one is available.
+*/
+func (bucket *tokenBucket) wait() {
+	for {
+		bucket.lock.Lock()
+		bucket.refill()
+		if bucket.tokens >= 1 {
+			bucket.tokens--
+			bucket.lock.Unlock()
+			return
+		}
+		delay := bucket.delay()
+		bucket.lock.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+/*
+	How long until the next token is available, must hold the lock.
+*/
+func (bucket *tokenBucket) delay() time.Duration {
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+/*
+	How long until the next token is available.
+*/
+func (bucket *tokenBucket) nextToken() time.Duration {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	bucket.refill()
+	return bucket.delay()
+}
@@ -0,0 +1,30 @@
+package silicon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	bucket := newTokenBucket(2, 1)
+	if !bucket.take() || !bucket.take() {
+		t.Fatalf("Expecting a full bucket to allow two takes")
+	}
+	if bucket.take() {
+		t.Fatalf("Expecting an empty bucket to refuse a take")
+	}
+	if delay := bucket.nextToken(); delay <= 0 || delay > time.Second {
+		t.Fatalf("Expecting the next token within a second, received %v", delay)
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	bucket := newTokenBucket(1, 50)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		bucket.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("Expecting wait to be rate limited, took %v", elapsed)
+	}
+}
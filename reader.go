@@ -0,0 +1,204 @@
+package silicon
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/robyoung/go-whisper"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+	A series of values read back for a key. Values are evenly spaced by
+	Step seconds starting at From, missing values are NaN.
+*/
+type Series struct {
+	Key    string
+	From   int64
+	Until  int64
+	Step   int
+	Values []float64
+}
+
+/*
+	Reads data points from Whisper files and merges in any points still
+	waiting in the cache so that unflushed data is visible to readers.
+*/
+type Reader struct {
+	basePath string
+	resolver StorageResolver
+	cache    MetricCache
+}
+
+/*
+	Create a new reader over the files under `basePath`. The resolver is used
+	to determine the step for keys that only exist in the cache.
+*/
+func NewReader(basePath string, resolver StorageResolver, cache MetricCache) *Reader {
+	return &Reader{basePath, resolver, cache}
+}
+
+/*
+	Fetch the series for key between from and until (unix timestamps).
+*/
+func (reader *Reader) Fetch(key string, from, until int64) (*Series, error) {
+	if err := checkQueryKey(key); err != nil {
+		return nil, err
+	}
+	if from >= until {
+		return nil, fmt.Errorf("Invalid time range, from %v must be before until %v", from, until)
+	}
+	series, err := reader.fetchWhisper(key, from, until)
+	if err != nil {
+		return nil, err
+	}
+	if series == nil {
+		series, err = reader.emptySeries(key, from, until)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader.mergeCache(series)
+
+	return series, nil
+}
+
+func (reader *Reader) fetchWhisper(key string, from, until int64) (*Series, error) {
+	fullPath := WhisperPath(reader.basePath, key)
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	file, err := whisper.Open(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("Open error: %v", err)
+	}
+	defer file.Close()
+	result, err := file.Fetch(int(from), int(until))
+	if err != nil {
+		return nil, fmt.Errorf("Fetch error: %v", err)
+	}
+	if result == nil {
+		return nil, nil
+	}
+
+	return &Series{key, int64(result.FromTime()), int64(result.UntilTime()), result.Step(), result.Values()}, nil
+}
+
+/*
+	Build an empty series for a key that has no Whisper file yet, using the
+	highest precision archive that covers the requested range.
+*/
+func (reader *Reader) emptySeries(key string, from, until int64) (*Series, error) {
+	retentions, _, _, err := reader.resolver.Find(key)
+	if err != nil {
+		return nil, fmt.Errorf("Resolver error: %v", err)
+	}
+	if len(retentions) == 0 {
+		return nil, fmt.Errorf("No retentions found for '%v'", key)
+	}
+	age := time.Now().Unix() - from
+	retention := retentions[len(retentions)-1]
+	for _, candidate := range retentions {
+		if int64(candidate.MaxRetention()) >= age {
+			retention = candidate
+			break
+		}
+	}
+	step := int64(retention.SecondsPerPoint())
+	from = from - (from % step) + step
+	until = until - (until % step) + step
+	values := make([]float64, (until-from)/step)
+	for i := range values {
+		values[i] = math.NaN()
+	}
+
+	return &Series{key, from, until, int(step), values}, nil
+}
+
+/*
+	Overlay points from the cache onto the series, later points win.
+*/
+func (reader *Reader) mergeCache(series *Series) {
+	if reader.cache == nil || series.Step <= 0 {
+		return
+	}
+	for _, point := range reader.cache.Get(series.Key) {
+		step := int64(series.Step)
+		bucket := point.timestamp - (point.timestamp % step)
+		if bucket < series.From || bucket >= series.Until {
+			continue
+		}
+		index := (bucket - series.From) / step
+		if index < int64(len(series.Values)) {
+			series.Values[index] = point.value
+		}
+	}
+}
+
+/*
+	Serve series as JSON. Expects `target`, and optionally `from` and
+	`until` unix timestamps in the query string. Until defaults to now and
+	from defaults to one day before until.
+*/
+func (reader *Reader) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	key := query.Get("target")
+	if key == "" {
+		http.Error(response, "Missing target", http.StatusBadRequest)
+		return
+	}
+	if err := checkQueryKey(key); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseTimeParam(query.Get("until"), time.Now().Unix())
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(query.Get("from"), until-24*60*60)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := reader.Fetch(key, from, until)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(series.toJSON())
+}
+
+func parseTimeParam(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid timestamp '%v'", value)
+	}
+	return result, nil
+}
+
+type seriesJSON struct {
+	Target string     `json:"target"`
+	From   int64      `json:"from"`
+	Until  int64      `json:"until"`
+	Step   int        `json:"step"`
+	Values []*float64 `json:"values"`
+}
+
+// JSON has no NaN so missing values are encoded as null
+func (series *Series) toJSON() *seriesJSON {
+	values := make([]*float64, len(series.Values))
+	for i := range series.Values {
+		if !math.IsNaN(series.Values[i]) {
+			values[i] = &series.Values[i]
+		}
+	}
+	return &seriesJSON{series.Key, series.From, series.Until, series.Step, values}
+}
@@ -0,0 +1,111 @@
+package silicon
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReaderFetchCacheOnly(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	cache := NewMetricCache()
+	now := time.Now().Unix()
+	cache.Store(&Metric{"foo.bar", DataPoint{42, now - 5}})
+	reader := NewReader(path, resolver, cache)
+
+	series, err := reader.Fetch("foo.bar", now-10, now)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if series.Step != 1 {
+		t.Fatalf("Expecting a step of 1, received %v", series.Step)
+	}
+	found := 0
+	for _, value := range series.Values {
+		if !math.IsNaN(value) {
+			if value != 42 {
+				t.Fatalf("Expecting cached value 42, received %v", value)
+			}
+			found++
+		}
+	}
+	if found != 1 {
+		t.Fatalf("Expecting one cached value, received %v", found)
+	}
+}
+
+func TestReaderFetchMergesWhisper(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	now := time.Now().Unix()
+	writer := NewWriter(path, resolver)
+	writer.Send("foo.bar", makeGoodPoints(5, 1))
+	writer.Close()
+
+	cache := NewMetricCache()
+	cache.Store(&Metric{"foo.bar", DataPoint{200, now - 7}})
+	reader := NewReader(path, resolver, cache)
+
+	series, err := reader.Fetch("foo.bar", now-10, now)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	counts := make(map[float64]int)
+	for _, value := range series.Values {
+		if !math.IsNaN(value) {
+			counts[value]++
+		}
+	}
+	if counts[100] != 5 || counts[200] != 1 {
+		t.Fatalf("Expecting five written and one cached value, received %v", counts)
+	}
+}
+
+func TestReaderServeHTTP(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	cache := NewMetricCache()
+	now := time.Now().Unix()
+	cache.Store(&Metric{"foo.bar", DataPoint{42, now - 5}})
+	server := httptest.NewServer(NewReader(path, resolver, cache))
+	defer server.Close()
+
+	response, err := http.Get(fmt.Sprintf("%v/?target=foo.bar&from=%v&until=%v", server.URL, now-10, now))
+	if err != nil {
+		t.Fatalf("Failed to request series: %v", err)
+	}
+	defer response.Body.Close()
+	var result seriesJSON
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode series: %v", err)
+	}
+	if result.Target != "foo.bar" || len(result.Values) != 10 {
+		t.Fatalf("Invalid series %v", result)
+	}
+
+	response, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to request series: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expecting a bad request without a target, received %v", response.StatusCode)
+	}
+
+	response, err = http.Get(server.URL + "/?target=..%2F..%2Fother")
+	if err != nil {
+		t.Fatalf("Failed to request series: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expecting a bad request for a target outside the data directory, received %v", response.StatusCode)
+	}
+}
@@ -2,36 +2,146 @@ package silicon
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-type Receiver struct {
+/*
+	Accepts connections on a listener and serves each on its own goroutine,
+	keeping track of the open connections so that they can be drained.
+	Connections are closed once serve returns.
+*/
+type acceptLoop struct {
 	listener net.Listener
-	cache    MetricCache
+	serve    func(net.Conn)
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+	closing  bool
+	active   sync.WaitGroup
+	done     chan bool
 }
 
-func NewMetricReceiver(listener net.Listener, cache MetricCache) *Receiver {
-	receiver := &Receiver{listener, cache}
-	go receiver.run()
+func newAcceptLoop(listener net.Listener, serve func(net.Conn)) *acceptLoop {
+	loop := &acceptLoop{listener: listener, serve: serve, conns: make(map[net.Conn]bool), done: make(chan bool)}
+	go loop.run()
 
-	return receiver
+	return loop
 }
 
-func (receiver *Receiver) run() {
+func (loop *acceptLoop) run() {
+	defer close(loop.done)
 	for {
-		conn, err := receiver.listener.Accept()
+		conn, err := loop.listener.Accept()
 		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && !opErr.Temporary() {
+				return
+			}
 			log.Printf("Failed to accept connection %v", err)
+			continue
+		}
+		if !loop.track(conn) {
+			conn.Close()
+			return
 		}
-		go receiver.read(conn)
+		go func() {
+			defer loop.untrack(conn)
+			loop.serve(conn)
+		}()
+	}
+}
+
+func (loop *acceptLoop) track(conn net.Conn) bool {
+	loop.lock.Lock()
+	defer loop.lock.Unlock()
+	if loop.closing {
+		return false
+	}
+	loop.conns[conn] = true
+	loop.active.Add(1)
+	return true
+}
+
+func (loop *acceptLoop) untrack(conn net.Conn) {
+	conn.Close()
+	loop.lock.Lock()
+	delete(loop.conns, conn)
+	loop.lock.Unlock()
+	loop.active.Done()
+}
+
+/*
+	Stop accepting connections and stop reading from the open ones, then
+	wait for what has already been read to be handled. Clients such as
+	relays keep their connections open so they are not waited for. Once ctx
+	is done any still being handled are closed and ctx's error is returned.
+*/
+func (loop *acceptLoop) Shutdown(ctx context.Context) error {
+	loop.lock.Lock()
+	loop.closing = true
+	loop.lock.Unlock()
+	loop.listener.Close()
+	<-loop.done
+
+	loop.lock.Lock()
+	for conn := range loop.conns {
+		closeRead(conn)
+	}
+	loop.lock.Unlock()
+	drained := make(chan bool)
+	go func() {
+		loop.active.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+	loop.lock.Lock()
+	for conn := range loop.conns {
+		conn.Close()
+	}
+	loop.lock.Unlock()
+	<-drained
+	return ctx.Err()
+}
+
+// reads see the end of the stream while a response can still be written
+func closeRead(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && tcpConn.CloseRead() == nil {
+		return
 	}
+	conn.Close()
+}
+
+type Receiver struct {
+	loop  *acceptLoop
+	cache MetricCache
+}
+
+func NewMetricReceiver(listener net.Listener, cache MetricCache) *Receiver {
+	receiver := &Receiver{cache: cache}
+	receiver.loop = newAcceptLoop(listener, receiver.read)
+
+	return receiver
+}
+
+/*
+	Stop accepting connections and reading from the open ones, see
+	acceptLoop.Shutdown.
+*/
+func (receiver *Receiver) Shutdown(ctx context.Context) error {
+	return receiver.loop.Shutdown(ctx)
 }
 
 func (receiver *Receiver) read(conn net.Conn) {
-	fmt.Println("WE ARE READY TO READ")
 	reader := bufio.NewReader(conn)
 	for {
 		line, prefix, err := reader.ReadLine()
@@ -40,10 +150,12 @@ func (receiver *Receiver) read(conn net.Conn) {
 		}
 		if err != nil {
 			if err == io.EOF {
-				conn.Close()
 				return
-			} else {
-				log.Printf("Metric read error: %v", err)
+			}
+			log.Printf("Metric read error: %v", err)
+			if !prefix {
+				// the connection is broken or was closed
+				return
 			}
 		} else {
 			metric, err := ParseLineMetric(string(line))
@@ -55,3 +167,141 @@ func (receiver *Receiver) read(conn net.Conn) {
 		}
 	}
 }
+
+// the largest pickle payload accepted, matches carbon's MAX_LENGTH
+const maxPickleLength = 1 << 20
+
+/*
+	Receives metrics using carbon's pickle protocol. Each message is a four
+	byte big endian length followed by a pickled list of
+	(path, (timestamp, value)) tuples.
+*/
+type PickleReceiver struct {
+	loop  *acceptLoop
+	cache MetricCache
+}
+
+func NewPickleReceiver(listener net.Listener, cache MetricCache) *PickleReceiver {
+	receiver := &PickleReceiver{cache: cache}
+	receiver.loop = newAcceptLoop(listener, receiver.read)
+
+	return receiver
+}
+
+/*
+	Stop accepting connections and reading from the open ones, see
+	acceptLoop.Shutdown.
+*/
+func (receiver *PickleReceiver) Shutdown(ctx context.Context) error {
+	return receiver.loop.Shutdown(ctx)
+}
+
+func (receiver *PickleReceiver) read(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				log.Printf("Pickle read error: %v", err)
+			}
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > maxPickleLength {
+			log.Printf("Pickle message too long: %v bytes", length)
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			log.Printf("Pickle read error: %v", err)
+			return
+		}
+		metrics, err := ParsePickleMetrics(payload)
+		if err != nil {
+			// any valid metrics in the batch are still stored
+			log.Printf("Invalid pickle: %v", err)
+		}
+		for _, metric := range metrics {
+			receiver.cache.Store(metric)
+		}
+	}
+}
+
+// the largest UDP datagram that can be received
+const maxDatagramLength = 65535
+
+/*
+	Receives plaintext metrics over UDP. Each datagram may contain one or
+	more newline separated lines, a bad line is counted and skipped without
+	losing the rest of the datagram.
+*/
+type UDPReceiver struct {
+	conn     net.PacketConn
+	cache    MetricCache
+	received int64
+	invalid  int64
+	done     chan bool
+}
+
+func NewUDPReceiver(conn net.PacketConn, cache MetricCache) *UDPReceiver {
+	receiver := &UDPReceiver{conn: conn, cache: cache, done: make(chan bool)}
+	go receiver.run()
+
+	return receiver
+}
+
+/*
+	Close the connection and wait for the datagram being read, if any, to
+	be stored. There are no connections to drain so ctx is not used.
+*/
+func (receiver *UDPReceiver) Shutdown(ctx context.Context) error {
+	err := receiver.conn.Close()
+	<-receiver.done
+	return err
+}
+
+/*
+	Return the number of metrics stored and the number of lines rejected.
+*/
+func (receiver *UDPReceiver) Counts() (received, invalid int64) {
+	return atomic.LoadInt64(&receiver.received), atomic.LoadInt64(&receiver.invalid)
+}
+
+func (receiver *UDPReceiver) run() {
+	defer close(receiver.done)
+	buffer := make([]byte, maxDatagramLength)
+	for {
+		n, addr, err := receiver.conn.ReadFrom(buffer)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && !opErr.Temporary() {
+				return
+			}
+			log.Printf("Datagram read error: %v", err)
+			continue
+		}
+		received, invalid, lastErr := receiver.read(string(buffer[:n]))
+		if invalid > 0 {
+			log.Printf("Invalid metrics from %v: %v of %v lines, last error: %v", addr, invalid, received+invalid, lastErr)
+		}
+	}
+}
+
+func (receiver *UDPReceiver) read(datagram string) (received, invalid int, lastErr error) {
+	for _, line := range strings.Split(datagram, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		metric, err := ParseLineMetric(line)
+		if err != nil {
+			atomic.AddInt64(&receiver.invalid, 1)
+			invalid++
+			lastErr = err
+		} else {
+			atomic.AddInt64(&receiver.received, 1)
+			receiver.cache.Store(metric)
+			received++
+		}
+	}
+	return
+}
@@ -2,6 +2,8 @@ package silicon
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
@@ -96,3 +98,134 @@ func xTestLineReciever(t *testing.T) {
 	time.Sleep(1000 * time.Millisecond)
 
 }
+
+func waitForSize(cache MetricCache, size int) int {
+	for i := 0; i < 100; i++ {
+		if current := cache.Size(); current >= size {
+			return current
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cache.Size()
+}
+
+func TestPickleReceiver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	cache := NewMetricCache()
+	NewPickleReceiver(listener, cache)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	payload := []byte(picklesByProtocol[2])
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	conn.Write(header)
+	conn.Write(payload)
+	conn.Close()
+
+	if size := waitForSize(cache, 2); size != 2 {
+		t.Fatalf("Expecting 2 metrics in the cache, received %v", size)
+	}
+	if points := cache.Pop("foo.bar"); len(points) != 1 || points[0].value != 1.5 {
+		t.Fatalf("Invalid points for foo.bar %v", points)
+	}
+}
+
+func TestUDPReceiver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	cache := NewMetricCache()
+	receiver := NewUDPReceiver(conn, cache)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	fmt.Fprintf(client, "foo.bar 1 1234\nfoo.bar 1a 1235\nfoo.baz 2 1236\n")
+	client.Close()
+
+	if size := waitForSize(cache, 2); size != 2 {
+		t.Fatalf("Expecting 2 metrics in the cache, received %v", size)
+	}
+	received, invalid := receiver.Counts()
+	if received != 2 || invalid != 1 {
+		t.Fatalf("Expecting 2 received and 1 invalid, received %v and %v", received, invalid)
+	}
+}
+
+func TestReceiverShutdownClosesConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	cache := NewMetricCache()
+	receiver := NewMetricReceiver(listener, cache)
+
+	// relays keep their connections open
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "foo.bar 1 1234\n")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := receiver.Shutdown(ctx); err != nil {
+		t.Fatalf("Expecting a clean shutdown without waiting for the client, received %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatalf("Expecting new connections to be refused")
+	}
+	if size := cache.Size(); size != 1 {
+		t.Fatalf("Expecting the point sent before shutting down to be stored, received %v", size)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expecting the connection to be closed, received %v", err)
+	}
+}
+
+// holds every Store until released
+type stalledCache struct {
+	MetricCache
+	release chan bool
+}
+
+func (cache *stalledCache) Store(metric *Metric) {
+	<-cache.release
+	cache.MetricCache.Store(metric)
+}
+
+func TestReceiverShutdownDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	cache := &stalledCache{NewMetricCache(), make(chan bool)}
+	receiver := NewMetricReceiver(listener, cache)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "foo.bar 1 1234\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, func() { close(cache.release) })
+	if err := receiver.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expecting the deadline to be exceeded, received %v", err)
+	}
+	if size := cache.Size(); size != 1 {
+		t.Fatalf("Expecting the point being stored to be waited for, received %v", size)
+	}
+}
@@ -0,0 +1,238 @@
+package silicon
+
+import (
+	"fmt"
+	"github.com/robyoung/go-whisper"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	Describes how an existing Whisper file differs from what the storage
+	rules now give for its key.
+*/
+type Reconciliation struct {
+	Key     string
+	Path    string
+	Applied bool
+
+	header            *whisperHeader
+	retentions        whisper.Retentions
+	aggregationMethod whisper.AggregationMethod
+	xFilesFactor      float32
+}
+
+/*
+	True if the archives need to change, which means rewriting the file.
+*/
+func (r *Reconciliation) Resize() bool {
+	if len(r.header.archives) != len(r.retentions) {
+		return true
+	}
+	for i, archive := range r.header.archives {
+		if archive.secondsPerPoint != r.retentions[i].SecondsPerPoint() || archive.points != r.retentions[i].NumberOfPoints() {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	True if the aggregation method or xFilesFactor need to change, which can
+	be done in place.
+*/
+func (r *Reconciliation) Reaggregate() bool {
+	return r.header.aggregationMethod != r.aggregationMethod || r.header.xFilesFactor != r.xFilesFactor
+}
+
+func (r *Reconciliation) String() string {
+	var changes []string
+	if r.Resize() {
+		current := make([]string, len(r.header.archives))
+		for i, archive := range r.header.archives {
+			current[i] = fmt.Sprintf("%v:%v", archive.secondsPerPoint, archive.points)
+		}
+		expected := make([]string, len(r.retentions))
+		for i, retention := range r.retentions {
+			expected[i] = fmt.Sprintf("%v:%v", retention.SecondsPerPoint(), retention.NumberOfPoints())
+		}
+		changes = append(changes, fmt.Sprintf("retentions %v -> %v", strings.Join(current, ","), strings.Join(expected, ",")))
+	}
+	if r.Reaggregate() {
+		changes = append(changes, fmt.Sprintf("aggregation %v %v -> %v %v",
+			aggregationMethodName(r.header.aggregationMethod), r.header.xFilesFactor,
+			aggregationMethodName(r.aggregationMethod), r.xFilesFactor))
+	}
+	return fmt.Sprintf("%v (%v): %v", r.Key, r.Path, strings.Join(changes, ", "))
+}
+
+/*
+	Compares the Whisper files under a data directory with the storage rules
+	and optionally brings them into line, keeping the existing data.
+*/
+type reconciler struct {
+	basePath  string
+	resolver  StorageResolver
+	exclusive func(string, func() error) error
+	tagIndex  *TagIndex
+}
+
+/*
+	Create a reconciler for the files under basePath.
+*/
+func NewReconciler(basePath string, resolver StorageResolver) *reconciler {
+	r := new(reconciler)
+	r.basePath = basePath
+	r.resolver = resolver
+
+	return r
+}
+
+/*
+	Run changes through exclusive, which must call the action while nothing
+	else has the key's file open. Use the writer's Exclusive when the daemon
+	is running so that writes are not lost during a resize.
+*/
+func (r *reconciler) SetExclusive(exclusive func(key string, action func() error) error) {
+	r.exclusive = exclusive
+}
+
+/*
+	Look up the keys of tagged series in index. Their files are stored by
+	hash so without an index they are skipped.
+*/
+func (r *reconciler) SetTagIndex(index *TagIndex) {
+	r.tagIndex = index
+}
+
+/*
+	Map the file of every indexed tagged series to its key.
+*/
+func (r *reconciler) taggedKeys() map[string]string {
+	if r.tagIndex == nil {
+		return nil
+	}
+	keys := make(map[string]string)
+	for _, key := range r.tagIndex.Series() {
+		keys[filepath.Clean(taggedWhisperPath(r.basePath, key))] = key
+	}
+	return keys
+}
+
+/*
+	Walk the data directory and return every file that differs from the
+	storage rules. If apply is true each file is also resized or updated,
+	a failure is logged and the walk carries on.
+*/
+func (r *reconciler) Run(apply bool) ([]*Reconciliation, error) {
+	var result []*Reconciliation
+	taggedPath := filepath.Join(r.basePath, "_tagged")
+	taggedKeys := r.taggedKeys()
+	err := filepath.Walk(r.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == taggedPath && taggedKeys == nil {
+				log.Printf("Skipping tagged series under %v, they need a tag index to reconcile", path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".wsp" {
+			return nil
+		}
+		var key string
+		if strings.HasPrefix(path, taggedPath+string(filepath.Separator)) {
+			found, ok := taggedKeys[path]
+			if !ok {
+				log.Printf("Skipping %v, it is not in the tag index", path)
+				return nil
+			}
+			key = found
+		} else {
+			relative, err := filepath.Rel(r.basePath, path)
+			if err != nil {
+				return err
+			}
+			key = strings.Replace(strings.TrimSuffix(relative, ".wsp"), string(filepath.Separator), ".", -1)
+		}
+		reconciliation, err := r.check(key, path)
+		if err != nil {
+			log.Printf("Failed to check %v: %v", path, err)
+			return nil
+		}
+		if reconciliation == nil {
+			return nil
+		}
+		if apply {
+			if err := r.apply(reconciliation); err != nil {
+				log.Printf("Failed to reconcile %v: %v", reconciliation, err)
+			} else {
+				reconciliation.Applied = true
+			}
+		}
+		result = append(result, reconciliation)
+		return nil
+	})
+
+	return result, err
+}
+
+/*
+	Run every interval until stop is closed, logging each difference found.
+*/
+func (r *reconciler) RunEvery(interval time.Duration, apply bool, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		reconciliations, err := r.Run(apply)
+		if err != nil {
+			log.Printf("Failed to reconcile Whisper files: %v", err)
+		}
+		for _, reconciliation := range reconciliations {
+			if reconciliation.Applied {
+				log.Printf("Reconciled %v", reconciliation)
+			} else {
+				log.Printf("Needs reconciling %v", reconciliation)
+			}
+		}
+	}
+}
+
+func (r *reconciler) check(key, path string) (*Reconciliation, error) {
+	header, err := readWhisperHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	retentions, aggregationMethod, xFilesFactor, err := r.resolver.Find(key)
+	if err != nil {
+		return nil, err
+	}
+	reconciliation := &Reconciliation{key, path, false, header, retentions, aggregationMethod, xFilesFactor}
+	if !reconciliation.Resize() && !reconciliation.Reaggregate() {
+		return nil, nil
+	}
+	return reconciliation, nil
+}
+
+func (r *reconciler) apply(reconciliation *Reconciliation) error {
+	action := func() error {
+		if reconciliation.Resize() {
+			return ResizeWhisper(reconciliation.Path, reconciliation.retentions, reconciliation.aggregationMethod, reconciliation.xFilesFactor)
+		}
+		return SetWhisperAggregation(reconciliation.Path, reconciliation.aggregationMethod, reconciliation.xFilesFactor)
+	}
+	if r.exclusive != nil {
+		return r.exclusive(reconciliation.Key, action)
+	}
+	return action()
+}
@@ -0,0 +1,162 @@
+package silicon
+
+import (
+	"encoding/binary"
+	"github.com/robyoung/go-whisper"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+/*
+	Write just the header of a Whisper file, enough for it to be checked.
+*/
+func writeWhisperHeader(t *testing.T, filePath string, aggregationMethod whisper.AggregationMethod, xFilesFactor float32, archives ...whisperArchiveInfo) {
+	os.MkdirAll(path.Dir(filePath), os.ModeDir|os.ModePerm)
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+	maxRetention := archives[len(archives)-1].secondsPerPoint * archives[len(archives)-1].points
+	fields := []uint32{uint32(aggregationMethod), uint32(maxRetention), math.Float32bits(xFilesFactor), uint32(len(archives))}
+	for _, archive := range archives {
+		fields = append(fields, uint32(archive.offset), uint32(archive.secondsPerPoint), uint32(archive.points))
+	}
+	binary.Write(file, binary.BigEndian, fields)
+}
+
+func TestReconcilerReportsDifferences(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reconcile")
+	defer os.RemoveAll(dir)
+	// dummyResolver gives 1s:5m,1m:30m with sum and 0.5
+	writeWhisperHeader(t, path.Join(dir, "foo/match.wsp"), whisper.Sum, 0.5, whisperArchiveInfo{40, 1, 300}, whisperArchiveInfo{3640, 60, 30})
+	writeWhisperHeader(t, path.Join(dir, "foo/aggregation.wsp"), whisper.Max, 0.5, whisperArchiveInfo{40, 1, 300}, whisperArchiveInfo{3640, 60, 30})
+	writeWhisperHeader(t, path.Join(dir, "foo/resize.wsp"), whisper.Sum, 0.5, whisperArchiveInfo{28, 60, 1440})
+	ioutil.WriteFile(path.Join(dir, "foo/notes.txt"), []byte("not whisper"), 0644)
+
+	reconciliations, err := NewReconciler(dir, new(dummyResolver)).Run(false)
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if len(reconciliations) != 2 {
+		t.Fatalf("Expecting two files to differ, received %v", reconciliations)
+	}
+	aggregation, resize := reconciliations[0], reconciliations[1]
+	if aggregation.Key != "foo.aggregation" || aggregation.Resize() || !aggregation.Reaggregate() || aggregation.Applied {
+		t.Errorf("Expecting foo.aggregation to need only its aggregation changing, received %v", aggregation)
+	}
+	if resize.Key != "foo.resize" || !resize.Resize() || resize.Reaggregate() || resize.Applied {
+		t.Errorf("Expecting foo.resize to need only resizing, received %v", resize)
+	}
+}
+
+func TestReconcilerTaggedSeries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reconcile")
+	defer os.RemoveAll(dir)
+	indexed, unindexed := "foo;host=a", "foo;host=b"
+	writeWhisperHeader(t, taggedWhisperPath(dir, indexed), whisper.Max, 0.5, whisperArchiveInfo{40, 1, 300}, whisperArchiveInfo{3640, 60, 30})
+	writeWhisperHeader(t, taggedWhisperPath(dir, unindexed), whisper.Max, 0.5, whisperArchiveInfo{40, 1, 300}, whisperArchiveInfo{3640, 60, 30})
+
+	reconciler := NewReconciler(dir, new(dummyResolver))
+	reconciliations, err := reconciler.Run(false)
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if len(reconciliations) != 0 {
+		t.Fatalf("Expecting tagged series to be skipped without a tag index, received %v", reconciliations)
+	}
+
+	index, err := OpenTagIndex(path.Join(dir, "tags.idx"))
+	if err != nil {
+		t.Fatalf("Failed to open tag index: %v", err)
+	}
+	defer index.Close()
+	index.Add(indexed)
+	reconciler.SetTagIndex(index)
+	reconciliations, err = reconciler.Run(false)
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if len(reconciliations) != 1 || reconciliations[0].Key != indexed || !reconciliations[0].Reaggregate() {
+		t.Fatalf("Expecting only the indexed series to be reconciled by its key, received %v", reconciliations)
+	}
+}
+
+func TestReconcilerAppliesAggregation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reconcile")
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "foo/bar.wsp")
+	writeWhisperHeader(t, filePath, whisper.Max, 0.1, whisperArchiveInfo{40, 1, 300}, whisperArchiveInfo{3640, 60, 30})
+
+	reconciler := NewReconciler(dir, new(dummyResolver))
+	var exclusiveKey string
+	reconciler.SetExclusive(func(key string, action func() error) error {
+		exclusiveKey = key
+		return action()
+	})
+	reconciliations, err := reconciler.Run(true)
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if len(reconciliations) != 1 || !reconciliations[0].Applied {
+		t.Fatalf("Expecting the file to be reconciled, received %v", reconciliations)
+	}
+	if exclusiveKey != "foo.bar" {
+		t.Errorf("Expecting the change to be made exclusively, received %v", exclusiveKey)
+	}
+	header, err := readWhisperHeader(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if header.aggregationMethod != whisper.Sum || header.xFilesFactor != 0.5 || len(header.archives) != 2 {
+		t.Fatalf("Expecting the aggregation to be updated in place, received %v", header)
+	}
+}
+
+func TestResizeWhisperKeepsData(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reconcile")
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "bar.wsp")
+	retentions, _ := whisper.ParseRetentionDefs("1m:1h")
+	file, err := whisper.Create(filePath, retentions, whisper.Average, 0.5)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	now := int(time.Now().Unix())
+	file.UpdateMany([]*whisper.TimeSeriesPoint{{Time: now - 120, Value: 1}, {Time: now - 60, Value: 2}})
+	file.Close()
+
+	resized, _ := whisper.ParseRetentionDefs("1m:1d,1h:7d")
+	if err := ResizeWhisper(filePath, resized, whisper.Max, 0); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	header, err := readWhisperHeader(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if len(header.archives) != 2 || header.archives[0].points != 1440 || header.aggregationMethod != whisper.Max {
+		t.Fatalf("Expecting the new retentions, received %v", header)
+	}
+	file, err = whisper.Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+	series, err := file.Fetch(now-300, now)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	found := 0
+	for _, value := range series.Values() {
+		if value == 1 || value == 2 {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("Expecting existing points to be kept, received %v", series.Values())
+	}
+}
@@ -0,0 +1,71 @@
+package silicon
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+	Points that could not be written before shutting down are saved to a
+	recovery file in the plaintext protocol and loaded on the next start.
+*/
+
+/*
+	Append every point in data to the file at path in the plaintext
+	protocol, returning the number saved.
+*/
+func appendLineFile(path string, data map[string][]DataPoint) (int, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("Append error: %v", err)
+	}
+	writer := bufio.NewWriter(file)
+	count := 0
+	for key, points := range data {
+		for _, point := range points {
+			writer.WriteString(formatLineMetric(&Metric{key, point}) + "\n")
+			count++
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("Append error: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("Append error: %v", err)
+	}
+	return count, file.Close()
+}
+
+/*
+	Store every point in the recovery file at path into cache and remove
+	the file, returning the number loaded. A missing file loads nothing.
+*/
+func loadRecovery(path string, cache MetricCache) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Recovery error: %v", err)
+	}
+	defer file.Close()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		metric, err := ParseLineMetric(scanner.Text())
+		if err != nil {
+			log.Printf("Skipping invalid recovery record: %v", err)
+			continue
+		}
+		cache.Store(metric)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("Recovery error: %v", err)
+	}
+	return count, os.Remove(path)
+}
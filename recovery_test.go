@@ -0,0 +1,45 @@
+package silicon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestRecoveryRoundTrip(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "recovery")
+	defer os.RemoveAll(dir)
+	recoveryPath := path.Join(dir, "recovery.txt")
+
+	saved, err := appendLineFile(recoveryPath, map[string][]DataPoint{
+		"foo.bar":         {{1.5, 1234}, {0.1, 1235}},
+		"foo.baz;host=a1": {{-2e20, 1236}},
+	})
+	if err != nil || saved != 3 {
+		t.Fatalf("Expecting 3 points saved, received %v %v", saved, err)
+	}
+	// a second shutdown before loading appends
+	if _, err := appendLineFile(recoveryPath, map[string][]DataPoint{"foo.bar": {{3, 1237}}}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	cache := NewMetricCache()
+	loaded, err := loadRecovery(recoveryPath, cache)
+	if err != nil || loaded != 4 {
+		t.Fatalf("Expecting 4 points loaded, received %v %v", loaded, err)
+	}
+	if points := cache.Get("foo.bar"); !reflect.DeepEqual(points, []DataPoint{{1.5, 1234}, {0.1, 1235}, {3, 1237}}) {
+		t.Fatalf("Invalid points for foo.bar %v", points)
+	}
+	if points := cache.Get("foo.baz;host=a1"); !reflect.DeepEqual(points, []DataPoint{{-2e20, 1236}}) {
+		t.Fatalf("Invalid points for the tagged series %v", points)
+	}
+	if _, err := os.Stat(recoveryPath); !os.IsNotExist(err) {
+		t.Fatalf("Expecting the recovery file to be removed once loaded")
+	}
+	if loaded, err := loadRecovery(recoveryPath, cache); loaded != 0 || err != nil {
+		t.Fatalf("Expecting a missing recovery file to load nothing, received %v %v", loaded, err)
+	}
+}
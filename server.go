@@ -0,0 +1,363 @@
+package silicon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+/*
+	Options for an embedded Server.
+*/
+type ServerOptions struct {
+	// the configuration to run with, nil uses DefaultCarbonConf
+	Conf *CarbonConf
+	// used in place of reading Conf.SchemasPath and Conf.AggregationPath
+	Resolver StorageResolver
+	// reloads the storage config each time it receives, as on SIGHUP
+	Reload <-chan os.Signal
+}
+
+/*
+	A complete carbon-cache; receivers feeding a cache that is flushed to
+	Whisper files, and the CarbonLink and HTTP query APIs, all configured by
+	a CarbonConf.
+*/
+type Server struct {
+	options ServerOptions
+
+	cache      MetricCache
+	resolver   StorageResolver
+	writer     *writer
+	bolt       *cacheBolt
+	wal        *WAL
+	tagIndex   *TagIndex
+	receivers  []shutdowner
+	queries    []shutdowner
+	stop       chan bool
+	background sync.WaitGroup
+
+	shutdownOnce sync.Once
+	done         chan bool
+	err          error
+}
+
+// anything that stops accepting work and drains until ctx is done
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+/*
+	Create a server, nothing is opened until it is started.
+*/
+func NewServer(options ServerOptions) *Server {
+	if options.Conf == nil {
+		options.Conf = DefaultCarbonConf()
+	}
+	server := new(Server)
+	server.options = options
+	server.stop = make(chan bool)
+	server.done = make(chan bool)
+
+	return server
+}
+
+/*
+	Open the files and listeners and start serving. The server runs until
+	Shutdown is called or ctx is done, which drains with a deadline of
+	Conf.ShutdownTimeout. If starting fails anything already started is
+	shut down. Start must only be called once.
+*/
+func (server *Server) Start(ctx context.Context) error {
+	if err := server.start(); err != nil {
+		server.Shutdown(context.Background())
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := server.shutdownContext()
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		case <-server.done:
+		}
+	}()
+
+	return nil
+}
+
+// a deadline of Conf.ShutdownTimeout from now, or none if it is zero
+func (server *Server) shutdownContext() (context.Context, context.CancelFunc) {
+	if timeout := server.options.Conf.ShutdownTimeout; timeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (server *Server) start() error {
+	conf := server.options.Conf
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	policy, _ := ParseOverflowPolicy(conf.CacheOverflowPolicy)
+	strategy, _ := NewFlushStrategy(conf.CacheWriteStrategy)
+	if conf.CacheShards > 1 {
+		server.cache = NewBoundedShardedMetricCache(conf.CacheShards, conf.MaxCacheSize, conf.MaxCacheBytes, policy)
+	} else {
+		server.cache = NewBoundedMetricCache(conf.MaxCacheSize, conf.MaxCacheBytes, policy)
+	}
+
+	server.resolver = server.options.Resolver
+	if server.resolver == nil {
+		resolver, err := NewFileStorageResolver(conf.SchemasPath, conf.AggregationPath)
+		if err != nil {
+			return fmt.Errorf("Failed to read storage config: %v", err)
+		}
+		server.goBackground(func() { resolver.Watch(60*time.Second, server.options.Reload, server.stop) })
+		server.resolver = resolver
+	}
+	server.writer = NewWriter(conf.LocalDataDir, server.resolver)
+	server.writer.SetRateLimits(conf.MaxUpdatesPerSecond, conf.MaxCreatesPerMinute, server.cache)
+	server.writer.SetOpenFiles(conf.MaxOpenFiles)
+	server.writer.SetWorkers(conf.WriterWorkers)
+	server.writer.SetRetries(conf.WriteRetries, time.Duration(conf.WriteRetryDelay)*time.Millisecond)
+	server.writer.SetDeadLetter(server.dataFile(conf.DeadLetterFile, "deadletter.txt"))
+
+	// the writer's callbacks are set before the bolt starts sending to it
+	if conf.WALDir != "" {
+		wal, err := OpenWAL(conf.WALDir, int64(conf.WALSegmentSize))
+		if err != nil {
+			return fmt.Errorf("Failed to open WAL: %v", err)
+		}
+		server.wal = wal
+		server.writer.OnPersisted(wal.Confirm)
+	}
+	if conf.TagIndexFile != "" {
+		tagIndex, err := OpenTagIndex(conf.TagIndexFile)
+		if err != nil {
+			return fmt.Errorf("Failed to open tag index: %v", err)
+		}
+		server.tagIndex = tagIndex
+		server.writer.OnOpened(tagIndex.Observe)
+	}
+	if conf.ReconcileInterval > 0 {
+		reconciler := NewReconciler(conf.LocalDataDir, server.resolver)
+		reconciler.SetExclusive(server.writer.Exclusive)
+		if server.tagIndex != nil {
+			reconciler.SetTagIndex(server.tagIndex)
+		}
+		server.goBackground(func() {
+			reconciler.RunEvery(time.Duration(conf.ReconcileInterval)*time.Second, conf.ReconcileApply, server.stop)
+		})
+	}
+	// flushing while replaying so a backlog larger than the cache fits
+	server.bolt = NewCacheBolt(server.cache, server.writer, strategy)
+
+	// receivers write through the WAL when it is enabled
+	receiverCache := server.cache
+	if server.wal != nil {
+		receiverCache = NewWALCache(server.cache, server.wal)
+		replayed, err := server.wal.Replay(server.cache)
+		if err != nil {
+			return fmt.Errorf("Failed to replay WAL: %v", err)
+		}
+		log.Printf("Replayed %v points from WAL", replayed)
+	}
+	// points saved at the last shutdown go through the WAL like any other
+	recovered, err := loadRecovery(server.recoveryPath(), receiverCache)
+	if err != nil {
+		return err
+	}
+	if recovered > 0 {
+		log.Printf("Recovered %v points from %v", recovered, server.recoveryPath())
+	}
+	// invalid metrics are rejected before they reach the WAL or the cache
+	validatingCache := NewValidatingCache(receiverCache, conf.MaxMetricNameLength, conf.MaxMetricNameDepth, conf.SanitizeMetricNames)
+	validatingCache.SetPointRules(conf.ClampInfiniteValues,
+		time.Duration(conf.MaxTimestampAge)*time.Second, time.Duration(conf.MaxTimestampFuture)*time.Second, conf.AcceptNowTimestamps)
+	receiverCache = validatingCache
+
+	if conf.LineReceiverAddr != "" {
+		listener, err := net.Listen("tcp", conf.LineReceiverAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %v: %v", conf.LineReceiverAddr, err)
+		}
+		server.receivers = append(server.receivers, NewMetricReceiver(listener, receiverCache))
+	}
+	if conf.PickleReceiverAddr != "" {
+		listener, err := net.Listen("tcp", conf.PickleReceiverAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %v: %v", conf.PickleReceiverAddr, err)
+		}
+		server.receivers = append(server.receivers, NewPickleReceiver(listener, receiverCache))
+	}
+	if conf.UDPReceiverAddr != "" {
+		conn, err := net.ListenPacket("udp", conf.UDPReceiverAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %v: %v", conf.UDPReceiverAddr, err)
+		}
+		server.receivers = append(server.receivers, NewUDPReceiver(conn, receiverCache))
+	}
+	if conf.CacheQueryAddr != "" {
+		listener, err := net.Listen("tcp", conf.CacheQueryAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %v: %v", conf.CacheQueryAddr, err)
+		}
+		server.queries = append(server.queries, NewCarbonLinkListener(listener, server.cache, conf.LocalDataDir, server.resolver))
+	}
+	if conf.HTTPQueryAddr != "" {
+		listener, err := net.Listen("tcp", conf.HTTPQueryAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %v: %v", conf.HTTPQueryAddr, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics/fetch", NewReader(conf.LocalDataDir, server.resolver, server.cache))
+		if server.tagIndex != nil {
+			mux.Handle("/tags/", server.tagIndex)
+		}
+		httpServer := &http.Server{Handler: mux}
+		go func() {
+			if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+				log.Printf("HTTP server stopped: %v", err)
+			}
+		}()
+		server.queries = append(server.queries, httpServer)
+	}
+
+	return nil
+}
+
+func (server *Server) goBackground(run func()) {
+	server.background.Add(1)
+	go func() {
+		defer server.background.Done()
+		run()
+	}()
+}
+
+/*
+	Return the number of points that could not be written, by the first
+	node of their key and the kind of error. Points are counted once they
+	have been retried and put in the dead letter file.
+*/
+func (server *Server) WriteFailures() map[WriteFailure]int {
+	if server.writer == nil {
+		return map[WriteFailure]int{}
+	}
+	return server.writer.Failures()
+}
+
+/*
+	Shut the server down; stop accepting metrics and queries and stop
+	reading from open connections, waiting until ctx is done for what has
+	already been read to be handled. The cache is then flushed through the
+	writer for up to Conf.ShutdownTimeout, however long that took, and
+	points not yet written are saved to the recovery file to be loaded on
+	the next start. Shutdown returns ctx's error without waiting for the
+	flush, use Wait.
+*/
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.shutdownOnce.Do(func() {
+		go server.shutdown(ctx)
+	})
+	select {
+	case <-server.done:
+		return server.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+	Wait for the server to be shut down, returning the first error hit
+	while shutting down.
+*/
+func (server *Server) Wait() error {
+	<-server.done
+	return server.err
+}
+
+func (server *Server) shutdown(ctx context.Context) {
+	defer close(server.done)
+	var errors []error
+	// stop ingesting before the queries so points can still be read while draining
+	for _, group := range [][]shutdowner{server.receivers, server.queries} {
+		for _, service := range group {
+			if err := service.Shutdown(ctx); err != nil {
+				errors = append(errors, err)
+			}
+		}
+	}
+	close(server.stop)
+	server.background.Wait()
+
+	if server.writer != nil {
+		server.writer.LiftRateLimits()
+	}
+	if server.bolt != nil {
+		server.bolt.Close()
+	}
+	var data map[string][]DataPoint
+	if server.cache != nil {
+		data = server.cache.Close()
+	}
+	flushCtx, cancel := server.shutdownContext()
+	err := server.flush(flushCtx, data)
+	cancel()
+	if err != nil {
+		errors = append(errors, err)
+	}
+	if server.wal != nil {
+		if err := server.wal.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if server.tagIndex != nil {
+		if err := server.tagIndex.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if len(errors) > 0 {
+		server.err = errors[0]
+	}
+}
+
+/*
+	Write the points left in the cache through the writer and close it,
+	giving up once ctx is done. The points not sent by then and those the
+	writer has not persisted are saved to the recovery file.
+*/
+func (server *Server) flush(ctx context.Context, data map[string][]DataPoint) error {
+	unwritten := data
+	if server.writer != nil {
+		unwritten = server.writer.CloseContext(ctx, data)
+	}
+	if len(unwritten) == 0 {
+		return nil
+	}
+	// with the WAL these are also replayed, writing a point twice is harmless
+	saved, err := appendLineFile(server.recoveryPath(), unwritten)
+	if err != nil {
+		return err
+	}
+	log.Printf("Saved %v points not written before the deadline to %v", saved, server.recoveryPath())
+	return nil
+}
+
+func (server *Server) recoveryPath() string {
+	return server.dataFile(server.options.Conf.RecoveryFile, "recovery.txt")
+}
+
+// configured is used if set, otherwise name in the data directory
+func (server *Server) dataFile(configured, name string) string {
+	if configured != "" {
+		return configured
+	}
+	return path.Join(server.options.Conf.LocalDataDir, name)
+}
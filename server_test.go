@@ -0,0 +1,179 @@
+package silicon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, ctx context.Context) (*Server, string) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatalf("Failed to create data dir: %v", err)
+	}
+	conf := DefaultCarbonConf()
+	conf.LocalDataDir = dir
+	conf.LineReceiverAddr = "127.0.0.1:0"
+	conf.PickleReceiverAddr = ""
+	conf.CacheQueryAddr = ""
+	conf.HTTPQueryAddr = ""
+	server := NewServer(ServerOptions{Conf: conf, Resolver: new(dummyResolver)})
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	return server, dir
+}
+
+func lineReceiverAddr(server *Server) string {
+	return server.receivers[0].(*Receiver).loop.listener.Addr().String()
+}
+
+func TestServerStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server, dir := startTestServer(t, ctx)
+	defer os.RemoveAll(dir)
+
+	cancel()
+	stopped := make(chan error)
+	go func() { stopped <- server.Wait() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Expecting a clean shutdown, received %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting the server to stop when its context is done")
+	}
+	if _, err := net.Dial("tcp", lineReceiverAddr(server)); err == nil {
+		t.Fatalf("Expecting the line receiver to be closed")
+	}
+}
+
+func TestServerShutdownClosesConnections(t *testing.T) {
+	server, dir := startTestServer(t, context.Background())
+	defer os.RemoveAll(dir)
+
+	// relays keep their connections open
+	conn, err := net.Dial("tcp", lineReceiverAddr(server))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "foo.bar 1.5 %v\n", time.Now().Unix())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Expecting a clean shutdown without waiting for the client, received %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "foo", "bar.wsp")); err != nil {
+		t.Fatalf("Expecting the point to be written: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "recovery.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Expecting nothing to be saved for recovery")
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expecting a second Shutdown to report the first result, received %v", err)
+	}
+}
+
+func TestServerFlushesAfterDrainDeadline(t *testing.T) {
+	server, dir := startTestServer(t, context.Background())
+	defer os.RemoveAll(dir)
+
+	// only flushed when shutting down
+	server.cache.(*metricCache).SetFlushThresholds(100, time.Hour)
+	server.cache.Store(&Metric{"foo.bar", DataPoint{1.5, time.Now().Unix()}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.Shutdown(ctx)
+	server.Wait()
+	if _, err := os.Stat(path.Join(dir, "foo", "bar.wsp")); err != nil {
+		t.Fatalf("Expecting the cache to be flushed after draining ran out of time: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "recovery.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Expecting nothing to be saved for recovery")
+	}
+}
+
+func TestServerStartFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	conf := DefaultCarbonConf()
+	conf.LocalDataDir = os.TempDir()
+	conf.LineReceiverAddr = "127.0.0.1:0"
+	conf.PickleReceiverAddr = listener.Addr().String()
+	conf.CacheQueryAddr = ""
+	conf.HTTPQueryAddr = ""
+	server := NewServer(ServerOptions{Conf: conf, Resolver: new(dummyResolver)})
+	if err := server.Start(context.Background()); err == nil {
+		t.Fatalf("Expecting start to fail when an address is in use")
+	}
+	if err := server.Wait(); err != nil {
+		t.Fatalf("Expecting the started receivers to be shut down, received %v", err)
+	}
+}
+
+func TestServerSavesUnwrittenPoints(t *testing.T) {
+	server, dir := startTestServer(t, context.Background())
+	defer os.RemoveAll(dir)
+	server.Shutdown(context.Background())
+
+	// the writer is already closed so nothing more is written
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.flush(ctx, map[string][]DataPoint{"foo.bar": {{1.5, 1234}}})
+	cache := NewMetricCache()
+	if loaded, err := loadRecovery(path.Join(dir, "recovery.txt"), cache); loaded != 1 || err != nil {
+		t.Fatalf("Expecting the point to be saved past the deadline, received %v %v", loaded, err)
+	}
+}
+
+func TestServerReplaysBacklogLargerThanCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatalf("Failed to create data dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	walDir := path.Join(dir, "wal")
+	wal, _ := OpenWAL(walDir, 1024*1024)
+	now := time.Now().Unix()
+	for i := 0; i < 100; i++ {
+		wal.Append(&Metric{fmt.Sprintf("foo.bar%v", i%20), DataPoint{1, now - int64(i/20)}})
+	}
+	wal.Close()
+
+	conf := DefaultCarbonConf()
+	conf.LocalDataDir = dir
+	conf.WALDir = walDir
+	conf.MaxCacheSize = 10
+	conf.CacheOverflowPolicy = Block.String()
+	conf.LineReceiverAddr = "127.0.0.1:0"
+	conf.PickleReceiverAddr = ""
+	conf.CacheQueryAddr = ""
+	conf.HTTPQueryAddr = ""
+	server := NewServer(ServerOptions{Conf: conf, Resolver: new(dummyResolver)})
+	started := make(chan error)
+	go func() { started <- server.Start(context.Background()) }()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Failed to start: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expecting the cache to be flushed while replaying")
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expecting a clean shutdown, received %v", err)
+	}
+	if segments, _ := wal.segmentIndexes(); len(segments) != 1 {
+		t.Fatalf("Expecting the replayed segment to be confirmed and removed, received %v", segments)
+	}
+}
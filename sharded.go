@@ -0,0 +1,158 @@
+package silicon
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+/*
+	A MetricCache that partitions keys across a number of independent
+	metricCache shards so that ingestion is not limited to one goroutine.
+	All points for a key live on the same shard.
+*/
+type shardedMetricCache struct {
+	shards []*metricCache
+	ready  chan bool
+}
+
+/*
+	Create an unbounded sharded metric cache.
+*/
+func NewShardedMetricCache(shards int) *shardedMetricCache {
+	return NewBoundedShardedMetricCache(shards, 0, 0, DropNewest)
+}
+
+/*
+	Create a sharded metric cache where the limits hold across all the
+	shards together.
+*/
+func NewBoundedShardedMetricCache(shards, maxPoints, maxBytes int, policy OverflowPolicy) *shardedMetricCache {
+	if shards < 1 {
+		shards = 1
+	}
+	cache := new(shardedMetricCache)
+	cache.shards = make([]*metricCache, shards)
+	budget := newCacheBudget(maxPoints, maxBytes)
+	for i := range cache.shards {
+		cache.shards[i] = newBudgetedMetricCache(budget, policy)
+	}
+	cache.ready = make(chan bool, 1)
+	go cache.forwardNotify()
+
+	return cache
+}
+
+func (cache *shardedMetricCache) shard(key string) *metricCache {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return cache.shards[hash.Sum32()%uint32(len(cache.shards))]
+}
+
+func (cache *shardedMetricCache) Store(metric *Metric) {
+	cache.shard(metric.key).Store(metric)
+}
+
+func (cache *shardedMetricCache) Size() int {
+	total := 0
+	for _, shard := range cache.shards {
+		total += shard.Size()
+	}
+	return total
+}
+
+func (cache *shardedMetricCache) Pop(key string) []DataPoint {
+	return cache.shard(key).Pop(key)
+}
+
+func (cache *shardedMetricCache) Get(key string) []DataPoint {
+	return cache.shard(key).Get(key)
+}
+
+func (cache *shardedMetricCache) Counts() map[string]int {
+	result := make(map[string]int)
+	for _, shard := range cache.shards {
+		for key, count := range shard.Counts() {
+			result[key] = count
+		}
+	}
+	return result
+}
+
+func (cache *shardedMetricCache) Oldest() map[string]int64 {
+	result := make(map[string]int64)
+	for _, shard := range cache.shards {
+		for key, timestamp := range shard.Oldest() {
+			result[key] = timestamp
+		}
+	}
+	return result
+}
+
+func (cache *shardedMetricCache) Due() map[string]bool {
+	result := make(map[string]bool)
+	for _, shard := range cache.shards {
+		for key := range shard.Due() {
+			result[key] = true
+		}
+	}
+	return result
+}
+
+func (cache *shardedMetricCache) Notify() <-chan bool {
+	return cache.ready
+}
+
+func (cache *shardedMetricCache) SetFlushThresholds(maxPoints int, maxAge time.Duration) {
+	for _, shard := range cache.shards {
+		shard.SetFlushThresholds(maxPoints, maxAge)
+	}
+}
+
+func (cache *shardedMetricCache) Dropped() map[OverflowPolicy]int {
+	result := make(map[OverflowPolicy]int)
+	for _, shard := range cache.shards {
+		for policy, count := range shard.Dropped() {
+			result[policy] += count
+		}
+	}
+	return result
+}
+
+func (cache *shardedMetricCache) OnDropped(dropped func(string, int)) {
+	for _, shard := range cache.shards {
+		shard.OnDropped(dropped)
+	}
+}
+
+func (cache *shardedMetricCache) Close() map[string][]DataPoint {
+	result := make(map[string][]DataPoint)
+	for _, shard := range cache.shards {
+		for key, points := range shard.Close() {
+			result[key] = points
+		}
+	}
+	return result
+}
+
+/*
+	Merge the notifications from every shard into one channel, closing it
+	once every shard has closed.
+*/
+func (cache *shardedMetricCache) forwardNotify() {
+	var wait sync.WaitGroup
+	wait.Add(len(cache.shards))
+	for _, shard := range cache.shards {
+		go func(shard *metricCache) {
+			defer wait.Done()
+			for range shard.Notify() {
+				select {
+				case cache.ready <- true:
+				default:
+				}
+			}
+		}(shard)
+	}
+	wait.Wait()
+	close(cache.ready)
+}
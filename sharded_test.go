@@ -0,0 +1,126 @@
+package silicon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestShardedMetricCache(t *testing.T) {
+	cache := NewShardedMetricCache(4)
+	for i := 0; i < 10; i++ {
+		for j := 0; j <= i; j++ {
+			cache.Store(metric(fmt.Sprintf("foo.%v", i)))
+		}
+	}
+	if size := cache.Size(); size != 55 {
+		t.Fatalf("Expecting Size to be 55, received %v", size)
+	}
+	counts := cache.Counts()
+	if length := len(counts); length != 10 {
+		t.Fatalf("Expecting Counts length to be 10, received %v", length)
+	}
+	if count := counts["foo.4"]; count != 5 {
+		t.Fatalf("Expecting a count of 5 for foo.4, received %v", count)
+	}
+	if points := cache.Get("foo.4"); len(points) != 5 {
+		t.Fatalf("Expecting Get to return 5 points, received %v", len(points))
+	}
+	if points := cache.Pop("foo.4"); len(points) != 5 {
+		t.Fatalf("Expecting Pop to return 5 points, received %v", len(points))
+	}
+	if size := cache.Size(); size != 50 {
+		t.Fatalf("Expecting Pop to reduce Size to 50, received %v", size)
+	}
+	if length := len(cache.Close()); length != 9 {
+		t.Fatalf("Expecting Close to return 9 keys, received %v", length)
+	}
+}
+
+func TestShardedMetricCacheNotify(t *testing.T) {
+	cache := NewShardedMetricCache(4)
+	cache.Store(metric("foo.bar"))
+	select {
+	case <-cache.Notify():
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting Store to signal Notify")
+	}
+	cache.Close()
+	for range cache.Notify() {
+	}
+}
+
+func TestShardedMetricCacheBounded(t *testing.T) {
+	cache := NewBoundedShardedMetricCache(4, 5, 0, DropNewest)
+	for i := 0; i < 10; i++ {
+		cache.Store(metric("foo.bar"))
+	}
+	if size := cache.Size(); size != 5 {
+		t.Fatalf("Expecting one key to use the whole limit, received %v", size)
+	}
+	for i := 0; i < 10; i++ {
+		cache.Store(metric(fmt.Sprintf("foo.%v", i)))
+	}
+	if size := cache.Size(); size != 5 {
+		t.Fatalf("Expecting the limit to hold across shards, received %v", size)
+	}
+	if dropped := cache.Dropped()[DropNewest]; dropped != 15 {
+		t.Fatalf("Expecting 15 dropped points, received %v", dropped)
+	}
+	cache.Pop("foo.bar")
+	cache.Store(metric("foo.baz"))
+	if size := cache.Size(); size != 1 {
+		t.Fatalf("Expecting popped space to be reused by any shard, received %v", size)
+	}
+}
+
+func TestShardedMetricCacheBoundedBlock(t *testing.T) {
+	cache := NewBoundedShardedMetricCache(4, 1, 0, Block)
+	cache.Store(metric("foo.bar"))
+	stored := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			cache.Store(metric(fmt.Sprintf("foo.%v", i)))
+			cache.Pop(fmt.Sprintf("foo.%v", i))
+		}
+		close(stored)
+	}()
+	select {
+	case <-stored:
+		t.Fatalf("Expecting stores to block while another shard holds the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cache.Pop("foo.bar")
+	select {
+	case <-stored:
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting blocked stores to resume once another shard frees space")
+	}
+}
+
+func BenchmarkShardedMetricCache(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		benchmarkMetricCache(b, NewShardedMetricCache(8))
+	}
+}
+
+func benchmarkParallelStore(b *testing.B, cache MetricCache) {
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Store(&Metric{fmt.Sprintf("foo.%v", i%1000), DataPoint{123.234, 123456}})
+			i++
+		}
+	})
+	cache.Size()
+	b.StopTimer()
+	cache.Close()
+}
+
+func BenchmarkMetricCacheParallelStore(b *testing.B) {
+	benchmarkParallelStore(b, NewMetricCache())
+}
+
+func BenchmarkShardedMetricCacheParallelStore(b *testing.B) {
+	benchmarkParallelStore(b, NewShardedMetricCache(8))
+}
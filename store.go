@@ -4,13 +4,17 @@
 package silicon
 
 import (
+	"context"
 	"fmt"
-	"github.com/robyoung/go-cache"
 	"github.com/robyoung/go-whisper"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -29,26 +33,69 @@ type Writer interface {
 }
 
 /*
-	Retrieve Whisper configuration details for a given key.
+	Retrieve Whisper configuration details for a given key. Retentions are
+	returned in order of precision, finest first, as Whisper stores them.
 */
 type StorageResolver interface {
 	Find(string) (whisper.Retentions, whisper.AggregationMethod, float32, error)
 }
 
 type writer struct {
-	basePath string
-	resolver StorageResolver
-	in       chan *storageMessage
-	done     chan bool
+	basePath  string
+	resolver  StorageResolver
+	in        chan *storageMessage
+	done      chan bool
+	persisted func(string, int)
+	opened    func(string)
+	failed    func(string, int, error)
+
+	retries        int
+	retryDelay     time.Duration
+	deadLetterPath string
+	deadLetterLock sync.Mutex
+	failuresLock   sync.Mutex
+	failures       map[WriteFailure]int
+
+	updates      *tokenBucket
+	creates      *tokenBucket
+	requeue      MetricCache
+	requeueLock  sync.Mutex
+	requeues     map[*time.Timer]*storageMessage
+	requeuing    sync.WaitGroup
+	requeued     int64
+	droppedCount int64
+	lifted       int32
+
+	openFiles int
+	workers   int
+	startOnce sync.Once
+	closeOnce sync.Once
+
+	pendingLock sync.Mutex
+	pending     map[*storageMessage]int64 // sent but not yet persisted, failed or requeued, by the order sent
+	sent        int64
+	abandoned   chan bool
+	abandonOnce sync.Once
 }
 
+// how transient errors are retried unless SetRetries is called
+const (
+	defaultWriteRetries    = 3
+	defaultWriteRetryDelay = 100 * time.Millisecond
+)
+
+// the number of Whisper files kept open unless SetOpenFiles is called
+const defaultOpenFiles = 50
+
 type storageMessage struct {
 	key    string
 	points []DataPoint
+	action func()
 }
 
 /*
-	Stores metadata about an open whisper file.
+	Stores metadata about an open whisper file. The channels are only used
+	when each file has its own goroutine.
 */
 type writeMetadata struct {
 	whisper *whisper.Whisper
@@ -66,102 +113,512 @@ func NewWriter(basePath string, resolver StorageResolver) *writer {
 	w.resolver = resolver
 	w.in = make(chan *storageMessage)
 	w.done = make(chan bool)
-
-	go w.run()
+	w.retries = defaultWriteRetries
+	w.retryDelay = defaultWriteRetryDelay
+	w.failures = make(map[WriteFailure]int)
+	w.openFiles = defaultOpenFiles
+	w.pending = make(map[*storageMessage]int64)
+	w.abandoned = make(chan bool)
 
 	return w
 }
 
+/*
+	Register a function to be called with the key and number of points each
+	time a set of data points has been written, or has failed and been dead
+	lettered or dropped. Must be called before the first Send.
+*/
+func (w *writer) OnPersisted(persisted func(string, int)) {
+	w.persisted = persisted
+}
+
+/*
+	Register a function to be called with the key each time the writer
+	opens a file, whether it was just created or already existed. Must be
+	called before the first Send.
+*/
+func (w *writer) OnOpened(opened func(string)) {
+	w.opened = opened
+}
+
+/*
+	Register a function to be called with the key, number of points and
+	error each time a set of data points could not be written. Must be
+	called before the first Send.
+*/
+func (w *writer) OnFailed(failed func(string, int, error)) {
+	w.failed = failed
+}
+
+/*
+	Retry transient errors up to retries times, waiting delay before the
+	first retry and doubling it each time. Must be called before the first
+	Send.
+*/
+func (w *writer) SetRetries(retries int, delay time.Duration) {
+	w.retries = retries
+	w.retryDelay = delay
+}
+
+/*
+	Append points that could not be written to the file at path in the
+	plaintext protocol, so that they can be sent again once the problem is
+	fixed. By default they are dropped. Must be called before the first
+	Send.
+*/
+func (w *writer) SetDeadLetter(path string) {
+	w.deadLetterPath = path
+}
+
+/*
+	Keep up to maxOpen Whisper files open between writes. Each open file has
+	its own goroutine unless SetWorkers is used, so at least one must be
+	kept open. Must be called before the first Send.
+*/
+func (w *writer) SetOpenFiles(maxOpen int) {
+	w.openFiles = maxOpen
+}
+
+/*
+	Write with a fixed pool of workers rather than a goroutine per open
+	file. Keys are hashed to workers, which share the open files between
+	them; with no open files each set of points opens and closes its file.
+	There are never more workers than open files. Zero workers keeps a
+	goroutine per open file. Must be called before the first Send.
+*/
+func (w *writer) SetWorkers(workers int) {
+	w.workers = workers
+}
+
+/*
+	Return the number of points that could not be written, by the first
+	node of their key and the kind of error.
+*/
+func (w *writer) Failures() map[WriteFailure]int {
+	w.failuresLock.Lock()
+	defer w.failuresLock.Unlock()
+	result := make(map[WriteFailure]int, len(w.failures))
+	for failure, count := range w.failures {
+		result[failure] = count
+	}
+	return result
+}
+
+/*
+	Limit the rate of Whisper updates and of new file creation, a limit of
+	zero is unlimited. Updates wait for the limit, points for keys refused
+	creation are stored back into requeue once the limit allows, or dropped
+	if requeue is nil. Must be called before the first Send.
+*/
+func (w *writer) SetRateLimits(updatesPerSecond, createsPerMinute int, requeue MetricCache) {
+	if updatesPerSecond > 0 {
+		w.updates = newTokenBucket(float64(updatesPerSecond), float64(updatesPerSecond))
+	}
+	if createsPerMinute > 0 {
+		w.creates = newTokenBucket(float64(createsPerMinute), float64(createsPerMinute)/60)
+	}
+	w.requeue = requeue
+	w.requeues = make(map[*time.Timer]*storageMessage)
+}
+
+/*
+	Stop applying the rate limits so that the cache can be flushed as fast
+	as possible when shutting down. Points waiting to be requeued are stored
+	straight away and no more are refused or stored once this returns.
+*/
+func (w *writer) LiftRateLimits() {
+	// set by run so that a message being handled cannot be refused after
+	w.send(&storageMessage{action: func() { atomic.StoreInt32(&w.lifted, 1) }})
+	w.flushRequeues()
+}
+
+func (w *writer) limited() bool {
+	return atomic.LoadInt32(&w.lifted) == 0
+}
+
+/*
+	Return the number of points refused creation that were requeued and
+	that were dropped.
+*/
+func (w *writer) RateLimited() (requeued, dropped int64) {
+	return atomic.LoadInt64(&w.requeued), atomic.LoadInt64(&w.droppedCount)
+}
+
 /*
 	Send a set of data points to the whisper file identified by the key.
 */
 func (w *writer) Send(key string, points []DataPoint) {
-	w.in <- &storageMessage{key, points}
+	message := &storageMessage{key, points, nil}
+	w.track(message)
+	w.send(message)
 }
 
 /*
-	Close the writer, wait for all messages to be written and files to be closed.
+	Run action with the key's file closed and no writes to it happening,
+	so that the file can be safely replaced. Writes wait until it returns.
+*/
+func (w *writer) Exclusive(key string, action func() error) error {
+	result := make(chan error, 1)
+	w.send(&storageMessage{key, nil, func() { result <- action() }})
+	return <-result
+}
+
+/*
+	Close the writer, wait for all messages to be written and files to be
+	closed. Closing again does nothing.
 */
 func (w *writer) Close() {
-	close(w.in)
-	<-w.done
+	w.closeOnce.Do(func() {
+		w.start()
+		close(w.in)
+		<-w.done
+		w.flushRequeues()
+	})
 }
 
-func (w *writer) run() {
-	cache := w.createCache()
-	for message := range w.in {
-		value, _ := cache.Get(message.key)
-		var metadata *writeMetadata
-		if value != nil {
-			metadata = value.(*writeMetadata)
-		} else {
-			// TODO: consider moving this inside runWriter
-			file, err := w.createWhisper(message.key)
-			if err != nil {
-				log.Printf("Failed to create Whisper: %v", err)
-				metadata = &writeMetadata{}
-			} else {
-				metadata = &writeMetadata{file, make(chan *storageMessage), make(chan bool)}
+/*
+	Send data and close the writer, giving up once ctx is done. Messages not
+	yet written are then skipped and a write being retried gives up. Returns
+	the points that were not persisted, which is everything sent when ctx
+	ends first. A write already in progress may complete after this returns.
+*/
+func (w *writer) CloseContext(ctx context.Context, data map[string][]DataPoint) map[string][]DataPoint {
+	// tracked up front so that those never sent are returned too
+	messages := make([]*storageMessage, 0, len(data))
+	for key, points := range data {
+		message := &storageMessage{key, points, nil}
+		w.track(message)
+		messages = append(messages, message)
+	}
+	if ctx.Err() != nil {
+		w.abandon()
+	}
+	// sending and closing on one goroutine, left behind if the writer is stuck
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for _, message := range messages {
+			if w.isAbandoned() {
+				break
 			}
-			cache.Set(message.key, metadata)
-			go w.runWriter(metadata)
-		}
-		if metadata != nil {
-			metadata.in <- message
+			w.send(message)
 		}
+		w.Close()
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		w.abandon()
 	}
-	for _, key := range cache.Keys() {
-		// manually delete to cause the evictions to run
-		cache.Delete(key)
+	return w.unpersisted()
+}
+
+func (w *writer) abandon() {
+	w.abandonOnce.Do(func() { close(w.abandoned) })
+}
+
+func (w *writer) isAbandoned() bool {
+	select {
+	case <-w.abandoned:
+		return true
+	default:
+		return false
 	}
-	w.done <- true
 }
 
-func (w *writer) createCache() *cache.LRUCache {
-	c := cache.NewLRUCache(50) // TODO: make cache size configurable
-	c.SetEvictionHook(func(key string, value interface{}) {
-		metadata := value.(*writeMetadata)
-		close(metadata.in)
-		<-metadata.done
-		metadata.whisper.Close()
-	})
+/*
+	Return the points that have been sent but not yet written, dead
+	lettered, dropped or requeued, in the order they were sent.
+*/
+func (w *writer) unpersisted() map[string][]DataPoint {
+	w.pendingLock.Lock()
+	messages := make([]*storageMessage, 0, len(w.pending))
+	for message := range w.pending {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool { return w.pending[messages[i]] < w.pending[messages[j]] })
+	w.pendingLock.Unlock()
+
+	result := make(map[string][]DataPoint)
+	for _, message := range messages {
+		result[message.key] = append(result[message.key], message.points...)
+	}
+	return result
+}
+
+func (w *writer) track(message *storageMessage) {
+	w.pendingLock.Lock()
+	w.sent++
+	w.pending[message] = w.sent
+	w.pendingLock.Unlock()
+}
+
+func (w *writer) untrack(message *storageMessage) {
+	w.pendingLock.Lock()
+	delete(w.pending, message)
+	w.pendingLock.Unlock()
+}
+
+// the settings are fixed once the first message is sent
+func (w *writer) start() {
+	w.startOnce.Do(func() { go w.run() })
+}
+
+func (w *writer) send(message *storageMessage) {
+	w.start()
+	w.in <- message
+}
 
-	return c
+func (w *writer) run() {
+	var pool writePool
+	if w.workers > 0 {
+		pool = newWorkerPool(w, w.workers, w.openFiles)
+	} else {
+		pool = newFilePool(w, w.openFiles)
+	}
+	for message := range w.in {
+		if message.key == "" {
+			// applies to the whole writer
+			message.action()
+			continue
+		}
+		if message.action == nil && w.creates != nil && w.limited() &&
+			!pool.isOpen(message.key) && !w.exists(message.key) && !w.creates.take() {
+			w.refuse(message)
+			continue
+		}
+		pool.dispatch(message)
+	}
+	pool.close()
+	w.done <- true
 }
 
 func (w *writer) createWhisper(key string) (*whisper.Whisper, error) {
 	retentions, aggregationMethod, xFilesFactor, err := w.resolver.Find(key)
 	if err != nil {
-		return nil, fmt.Errorf("Resolver error: %v", err)
+		return nil, &writeError{resolveFailure, fmt.Errorf("Resolver error: %v", err)}
 	}
 	fullPath := w.getFullPath(key)
-	os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+	if err := os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm); err != nil {
+		return nil, newWriteError("Create error", err)
+	}
 
 	file, err := whisper.Create(fullPath, retentions, aggregationMethod, xFilesFactor)
-	if err != nil {
-		if err == os.ErrExist {
-			file, err = whisper.Open(fullPath)
+	if err == os.ErrExist {
+		file, err = whisper.Open(fullPath)
+		if err != nil {
+			return nil, newWriteError("Open error", err)
+		}
+	} else if err != nil {
+		return nil, newWriteError("Create error", err)
+	}
+
+	return file, nil
+}
+
+func (w *writer) exists(key string) bool {
+	_, err := os.Stat(w.getFullPath(key))
+	return err == nil
+}
+
+/*
+	Handle points for a key that was refused creation by the rate limit.
+*/
+func (w *writer) refuse(message *storageMessage) {
+	w.untrack(message)
+	if w.requeue == nil {
+		atomic.AddInt64(&w.droppedCount, int64(len(message.points)))
+		return
+	}
+	atomic.AddInt64(&w.requeued, int64(len(message.points)))
+	// wait for a token so the points do not bounce straight back
+	w.requeueLock.Lock()
+	defer w.requeueLock.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(w.creates.nextToken(), func() {
+		w.requeueLock.Lock()
+		_, pending := w.requeues[timer]
+		delete(w.requeues, timer)
+		if pending {
+			w.requeuing.Add(1)
+		}
+		w.requeueLock.Unlock()
+		if pending {
+			defer w.requeuing.Done()
+			w.store(message)
 		}
+	})
+	w.requeues[timer] = message
+}
+
+/*
+	Store any points still waiting to be requeued straight away, and wait
+	for timers that have already fired to finish storing theirs.
+*/
+func (w *writer) flushRequeues() {
+	w.requeueLock.Lock()
+	for timer, message := range w.requeues {
+		// a timer that has already fired will find itself removed and skip
+		timer.Stop()
+		delete(w.requeues, timer)
+		w.store(message)
 	}
+	w.requeueLock.Unlock()
+	w.requeuing.Wait()
+}
 
-	return file, fmt.Errorf("Create error: %v", err)
+func (w *writer) store(message *storageMessage) {
+	for _, point := range message.points {
+		w.requeue.Store(&Metric{message.key, point})
+	}
 }
 
 func (w *writer) getFullPath(key string) string {
-	return path.Join(w.basePath, strings.Replace(key, ".", "/", -1)+".wsp")
+	return WhisperPath(w.basePath, key)
 }
 
-func (w *writer) runWriter(metadata *writeMetadata) {
-	for message := range metadata.in {
-		metadata.whisper.UpdateMany(toTimeSeries(message.points))
+/*
+	Map a dot separated key to a Whisper file path under basePath. Tagged
+	series are stored under _tagged by the hash of their canonical key, so
+	the order tags are given in does not matter.
+*/
+func WhisperPath(basePath, key string) string {
+	if isTagged(key) {
+		if canonical, err := canonicalKey(key); err == nil {
+			key = canonical
+		}
+		return taggedWhisperPath(basePath, key)
+	}
+	return path.Join(basePath, strings.Replace(key, ".", "/", -1)+".wsp")
+}
+
+/*
+	Write the message's points, opening the file first if it is not open,
+	and report the outcome.
+*/
+func (w *writer) write(metadata *writeMetadata, message *storageMessage) {
+	if w.isAbandoned() {
+		return
+	}
+	sent := message
+	message = w.rejectTimestamps(message)
+	if len(message.points) > 0 {
+		err := w.retry(func() error {
+			if metadata.whisper == nil {
+				file, err := w.createWhisper(message.key)
+				if err != nil {
+					return err
+				}
+				metadata.whisper = file
+				if w.opened != nil {
+					w.opened(message.key)
+				}
+			}
+			if w.updates != nil && w.limited() {
+				w.updates.wait()
+			}
+			if err := metadata.whisper.UpdateMany(toTimeSeries(message.points)); err != nil {
+				return newWriteError("Update error", err)
+			}
+			return nil
+		})
+		if err != nil && w.isAbandoned() {
+			// left to be returned by CloseContext rather than failed
+			return
+		}
+		if err != nil {
+			w.fail(message, err)
+		} else if w.persisted != nil {
+			w.persisted(message.key, len(message.points))
+		}
+	}
+	w.untrack(sent)
+}
+
+/*
+	Fail the points with timestamps Whisper cannot store, such as the now
+	timestamp when nothing has resolved it, and return a message with the
+	rest.
+*/
+func (w *writer) rejectTimestamps(message *storageMessage) *storageMessage {
+	invalid := 0
+	for _, point := range message.points {
+		if !whisperTimestamp(point.timestamp) {
+			invalid++
+		}
+	}
+	if invalid == 0 {
+		return message
+	}
+	valid := &storageMessage{key: message.key, points: make([]DataPoint, 0, len(message.points)-invalid)}
+	rejected := &storageMessage{key: message.key, points: make([]DataPoint, 0, invalid)}
+	for _, point := range message.points {
+		if whisperTimestamp(point.timestamp) {
+			valid.points = append(valid.points, point)
+		} else {
+			rejected.points = append(rejected.points, point)
+		}
+	}
+	w.fail(rejected, &writeError{timestampFailure, fmt.Errorf("Invalid timestamp %v", rejected.points[0].timestamp)})
+	return valid
+}
+
+/*
+	Run write until it succeeds, fails with an error that is not transient
+	or has been retried as many times as allowed.
+*/
+func (w *writer) retry(write func() error) error {
+	delay := w.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= w.retries || !isTransient(err) {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.abandoned:
+			return err
+		}
+		delay *= 2
+	}
+}
+
+/*
+	Count the points that could not be written and put them in the dead
+	letter file. Points that reach the dead letter file count as persisted
+	so that they are not replayed from the WAL.
+*/
+func (w *writer) fail(message *storageMessage, err error) {
+	failure := WriteFailure{keyPrefix(message.key), failureKind(err)}
+	w.failuresLock.Lock()
+	w.failures[failure] += len(message.points)
+	w.failuresLock.Unlock()
+	if w.failed != nil {
+		w.failed(message.key, len(message.points), err)
+	}
+	if w.deadLetterPath == "" {
+		log.Printf("Dropped %v points for %v: %v", len(message.points), message.key, err)
+	} else {
+		w.deadLetterLock.Lock()
+		_, deadLetterErr := appendLineFile(w.deadLetterPath, map[string][]DataPoint{message.key: message.points})
+		w.deadLetterLock.Unlock()
+		if deadLetterErr != nil {
+			// not confirmed so that the WAL, if any, keeps the only copy
+			log.Printf("Failed to dead letter %v points for %v: %v, %v", len(message.points), message.key, err, deadLetterErr)
+			return
+		}
+		log.Printf("Dead lettered %v points for %v: %v", len(message.points), message.key, err)
+	}
+	// dropped points are confirmed too, replaying them would only fail again
+	if w.persisted != nil {
+		w.persisted(message.key, len(message.points))
 	}
-	metadata.done <- true
 }
 
 func toTimeSeries(points []DataPoint) []*whisper.TimeSeriesPoint {
 	result := make([]*whisper.TimeSeriesPoint, len(points))
 	for i, point := range points {
-		result[i] = &whisper.TimeSeriesPoint{point.timestamp, point.value}
+		result[i] = &whisper.TimeSeriesPoint{Time: int(point.timestamp), Value: point.value}
 	}
 	return result
 }
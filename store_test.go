@@ -1,10 +1,17 @@
 package silicon
 
 import (
+	"context"
 	"fmt"
 	"github.com/robyoung/go-whisper"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -21,7 +28,7 @@ func makeGoodPoints(count, step int) []DataPoint {
 	points := make([]DataPoint, count)
 	now := int(time.Now().Unix())
 	for i := 0; i < count; i++ {
-		points[i] = DataPoint{100, now - (i * step)}
+		points[i] = DataPoint{100, int64(now - (i * step))}
 	}
 	return points
 }
@@ -81,6 +88,91 @@ func TestWriter(t *testing.T) {
 	assertFetchedResults(t, result, 10, 100)
 }
 
+func TestWriterOnPersisted(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	persisted := make(map[string]int)
+	writer := NewWriter(path, resolver)
+	writer.OnPersisted(func(key string, count int) {
+		persisted[key] += count
+	})
+	writer.Send("foo.bar", makeGoodPoints(10, 1))
+	writer.Close()
+
+	if persisted["foo.bar"] != 10 {
+		t.Fatalf("Expecting 10 persisted points, received %v", persisted["foo.bar"])
+	}
+}
+
+func TestWriterCreateRateLimit(t *testing.T) {
+	path, fullPath, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	requeue := NewMetricCache()
+	writer := NewWriter(path, resolver)
+	writer.SetRateLimits(0, 1, requeue)
+	writer.Send("foo.bar", makeGoodPoints(10, 1))
+	writer.Send("foo.baz", makeGoodPoints(5, 1))
+	writer.Close()
+
+	if _, err := os.Stat(fullPath); err != nil {
+		t.Fatalf("Expecting the first key to be created: %v", err)
+	}
+	if _, err := os.Stat(path + "/foo/baz.wsp"); !os.IsNotExist(err) {
+		t.Fatalf("Expecting the second key to be refused creation")
+	}
+	if size := requeue.Size(); size != 5 {
+		t.Fatalf("Expecting 5 points to be requeued, received %v", size)
+	}
+	if requeued, dropped := writer.RateLimited(); requeued != 5 || dropped != 0 {
+		t.Fatalf("Expecting 5 requeued and 0 dropped, received %v and %v", requeued, dropped)
+	}
+}
+
+func TestWriterCreateRateLimitDrops(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	writer := NewWriter(path, resolver)
+	writer.SetRateLimits(0, 1, nil)
+	writer.Send("foo.bar", makeGoodPoints(10, 1))
+	writer.Send("foo.baz", makeGoodPoints(5, 1))
+	writer.Close()
+
+	if requeued, dropped := writer.RateLimited(); requeued != 0 || dropped != 5 {
+		t.Fatalf("Expecting 0 requeued and 5 dropped, received %v and %v", requeued, dropped)
+	}
+}
+
+type slowCache struct {
+	MetricCache
+	started chan bool
+}
+
+func (cache *slowCache) Store(metric *Metric) {
+	cache.started <- true
+	time.Sleep(20 * time.Millisecond)
+	cache.MetricCache.Store(metric)
+}
+
+func TestWriterLiftRateLimitsWaitsForRequeues(t *testing.T) {
+	requeue := &slowCache{NewMetricCache(), make(chan bool, 1)}
+	writer := NewWriter("/tmp/storage", new(dummyResolver))
+	defer writer.Close()
+	writer.SetRateLimits(0, 1, requeue)
+	// no tokens left, the next due in a millisecond
+	writer.creates = newTokenBucket(1, 1000)
+	writer.creates.take()
+	writer.refuse(&storageMessage{"foo.bar", makeGoodPoints(1, 1), nil})
+
+	<-requeue.started
+	writer.LiftRateLimits()
+	if size := requeue.Size(); size != 1 {
+		t.Fatalf("Expecting the requeue already in progress to finish, received %v points", size)
+	}
+}
+
 func benchmarkWriter(b *testing.B, makeWriter func(string, StorageResolver) Writer) {
 	path, _, resolver := setUp()
 	rand.Seed(12345)
@@ -111,3 +203,161 @@ func BenchmarkWriter(b *testing.B) {
 		return NewWriter(path, resolver)
 	})
 }
+
+func TestWriterExclusive(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+	writer := NewWriter(path, resolver)
+	defer writer.Close()
+
+	expected := fmt.Errorf("resize failed")
+	ran := false
+	err := writer.Exclusive("foo.bar", func() error {
+		ran = true
+		return expected
+	})
+	if !ran || err != expected {
+		t.Fatalf("Expecting the action to run and its error to be returned, received %v", err)
+	}
+}
+
+type failingResolver struct {
+}
+
+func (r *failingResolver) Find(key string) (whisper.Retentions, whisper.AggregationMethod, float32, error) {
+	return nil, 0, 0, fmt.Errorf("No storage schema for %v", key)
+}
+
+func TestWriterDeadLetters(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "deadletter")
+	defer os.RemoveAll(dir)
+	deadLetterPath := path.Join(dir, "deadletter.txt")
+
+	writer := NewWriter(dir, new(failingResolver))
+	writer.SetDeadLetter(deadLetterPath)
+	// called from each key's goroutine
+	var lock sync.Mutex
+	var failed, persisted int
+	writer.OnFailed(func(key string, count int, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		failed += count
+	})
+	writer.OnPersisted(func(key string, count int) {
+		lock.Lock()
+		defer lock.Unlock()
+		persisted += count
+	})
+	writer.Send("foo.bar", makeGoodPoints(10, 1))
+	writer.Send("foo.baz", makeGoodPoints(5, 1))
+	writer.Close()
+
+	if failures := writer.Failures(); !reflect.DeepEqual(failures, map[WriteFailure]int{{"foo", resolveFailure}: 15}) {
+		t.Fatalf("Expecting 15 points failed to resolve, received %v", failures)
+	}
+	if failed != 15 || persisted != 15 {
+		t.Fatalf("Expecting 15 failed points that count as persisted, received %v and %v", failed, persisted)
+	}
+	cache := NewMetricCache()
+	if loaded, _ := loadRecovery(deadLetterPath, cache); loaded != 15 || len(cache.Get("foo.bar")) != 10 {
+		t.Fatalf("Expecting 15 points in the dead letter file, received %v", loaded)
+	}
+}
+
+func TestWriterDropsConfirmed(t *testing.T) {
+	writer := NewWriter("/tmp/storage", new(failingResolver))
+	var lock sync.Mutex
+	persisted := 0
+	writer.OnPersisted(func(key string, count int) {
+		lock.Lock()
+		defer lock.Unlock()
+		persisted += count
+	})
+	writer.Send("foo.bar", makeGoodPoints(10, 1))
+	writer.Close()
+
+	if persisted != 10 {
+		t.Fatalf("Expecting dropped points to be confirmed, received %v", persisted)
+	}
+}
+
+func TestWriterRejectsInvalidTimestamps(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	writer := NewWriter(path, resolver)
+	var lock sync.Mutex
+	persisted := 0
+	writer.OnPersisted(func(key string, count int) {
+		lock.Lock()
+		defer lock.Unlock()
+		persisted += count
+	})
+	points := append(makeGoodPoints(3, 1), DataPoint{100, nowTimestamp}, DataPoint{100, math.MaxUint32 + 1})
+	writer.Send("foo.bar", points)
+	writer.Close()
+
+	if failures := writer.Failures(); !reflect.DeepEqual(failures, map[WriteFailure]int{{"foo", timestampFailure}: 2}) {
+		t.Fatalf("Expecting the unresolved now and out of range points to fail, received %v", failures)
+	}
+	if persisted != 5 {
+		t.Fatalf("Expecting written and rejected points to be confirmed, received %v", persisted)
+	}
+}
+
+type blockingResolver struct {
+	dummyResolver
+	release chan bool
+}
+
+func (r *blockingResolver) Find(key string) (whisper.Retentions, whisper.AggregationMethod, float32, error) {
+	<-r.release
+	return r.dummyResolver.Find(key)
+}
+
+func TestWriterCloseContext(t *testing.T) {
+	path, _, _ := setUpAndCheck(t)
+	defer tearDown(path)
+
+	resolver := &blockingResolver{release: make(chan bool)}
+	writer := NewWriter(path, resolver)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	unpersisted := writer.CloseContext(ctx, map[string][]DataPoint{
+		"foo.bar": makeGoodPoints(3, 1),
+		"foo.baz": makeGoodPoints(2, 1),
+	})
+	if len(unpersisted["foo.bar"]) != 3 || len(unpersisted["foo.baz"]) != 2 {
+		t.Fatalf("Expecting every point to be returned when the writer is stuck, received %v", unpersisted)
+	}
+	// let the stuck write finish before the files are removed
+	close(resolver.release)
+	writer.Close()
+}
+
+func TestWriterRetry(t *testing.T) {
+	writer := NewWriter("/tmp/storage", new(dummyResolver))
+	defer writer.Close()
+	writer.SetRetries(2, time.Millisecond)
+	transient := newWriteError("Update error", &os.PathError{Op: "write", Path: "foo.wsp", Err: syscall.EIO})
+	persistent := newWriteError("Create error", &os.PathError{Op: "open", Path: "foo.wsp", Err: syscall.EACCES})
+
+	for _, test := range []struct {
+		errors   []error
+		expected error
+		attempts int
+	}{
+		{[]error{transient, transient, nil}, nil, 3},
+		{[]error{transient, transient, transient, nil}, transient, 3},
+		{[]error{persistent, nil}, persistent, 1},
+	} {
+		attempts := 0
+		err := writer.retry(func() error {
+			attempts++
+			return test.errors[attempts-1]
+		})
+		if err != test.expected || attempts != test.attempts {
+			t.Errorf("Expecting %v after %v attempts, received %v after %v", test.expected, test.attempts, err, attempts)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package silicon
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+	Decides which keys a cache bolt should flush next, and in what order.
+	These mirror carbon's CACHE_WRITE_STRATEGY options.
+*/
+type FlushStrategy interface {
+	/*
+		Return the keys to pop from the cache in the order they should be
+		written. An empty result means there is nothing to flush.
+	*/
+	Order(MetricCache) []string
+}
+
+/*
+	Look up a flush strategy by its carbon name; max, sorted, naive or
+	timesorted.
+*/
+func NewFlushStrategy(name string) (FlushStrategy, error) {
+	switch name {
+	case "max":
+		return MaxStrategy{}, nil
+	case "sorted":
+		return SortedStrategy{}, nil
+	case "naive":
+		return NaiveStrategy{}, nil
+	case "timesorted":
+		return TimeSortedStrategy{}, nil
+	}
+	return nil, fmt.Errorf("Invalid flush strategy '%v'", name)
+}
+
+/*
+	Flush the keys with the most points first. This minimises the number of
+	writes but keys with few points may wait a long time. Rather than
+	looking for the largest key after every write, which makes draining the
+	cache quadratic, the order is taken from one snapshot of the counts per
+	pass, the same as SortedStrategy.
+*/
+type MaxStrategy struct{}
+
+func (MaxStrategy) Order(cache MetricCache) []string {
+	return SortedStrategy{}.Order(cache)
+}
+
+/*
+	Flush every key, largest first. The order is taken once per pass.
+*/
+type SortedStrategy struct{}
+
+func (SortedStrategy) Order(cache MetricCache) []string {
+	counts := cache.Counts()
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Sort(&keysByCount{keys, counts})
+	return keys
+}
+
+type keysByCount struct {
+	keys   []string
+	counts map[string]int
+}
+
+func (s *keysByCount) Len() int      { return len(s.keys) }
+func (s *keysByCount) Swap(i, j int) { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s *keysByCount) Less(i, j int) bool {
+	ci, cj := s.counts[s.keys[i]], s.counts[s.keys[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return s.keys[i] < s.keys[j]
+}
+
+/*
+	Flush every key in no particular order.
+*/
+type NaiveStrategy struct{}
+
+func (NaiveStrategy) Order(cache MetricCache) []string {
+	counts := cache.Counts()
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+/*
+	Flush every key, the key holding the oldest point first.
+*/
+type TimeSortedStrategy struct{}
+
+// caches that can report the oldest timestamp on each key in one snapshot
+type oldestReporter interface {
+	Oldest() map[string]int64
+}
+
+func (TimeSortedStrategy) Order(cache MetricCache) []string {
+	var timestamps map[string]int64
+	if reporter, ok := cache.(oldestReporter); ok {
+		timestamps = reporter.Oldest()
+	} else {
+		timestamps = make(map[string]int64)
+		for key := range cache.Counts() {
+			if points := cache.Get(key); len(points) > 0 {
+				timestamps[key] = oldestTimestamp(points)
+			}
+		}
+	}
+	keys := make([]string, 0, len(timestamps))
+	oldest := make(map[string]int, len(timestamps))
+	for key, timestamp := range timestamps {
+		keys = append(keys, key)
+		// negate so that keysByCount sorts oldest first
+		oldest[key] = -int(timestamp)
+	}
+	sort.Sort(&keysByCount{keys, oldest})
+	return keys
+}
+
+func oldestTimestamp(points []DataPoint) int64 {
+	timestamp := points[0].timestamp
+	for _, point := range points[1:] {
+		if point.timestamp < timestamp {
+			timestamp = point.timestamp
+		}
+	}
+	return timestamp
+}
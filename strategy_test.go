@@ -0,0 +1,105 @@
+package silicon
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func strategyCache() MetricCache {
+	cache := NewMetricCache()
+	cache.Store(&Metric{"foo.a", DataPoint{1, 1240}})
+	cache.Store(&Metric{"foo.b", DataPoint{1, 1236}})
+	cache.Store(&Metric{"foo.b", DataPoint{1, 1237}})
+	cache.Store(&Metric{"foo.c", DataPoint{1, 1238}})
+	cache.Store(&Metric{"foo.c", DataPoint{1, 1234}})
+	cache.Store(&Metric{"foo.c", DataPoint{1, 1239}})
+	cache.Store(&Metric{"foo.d", DataPoint{1, 1235}})
+	return cache
+}
+
+func TestMaxStrategy(t *testing.T) {
+	order := (MaxStrategy{}).Order(strategyCache())
+	if expected := []string{"foo.c", "foo.b", "foo.a", "foo.d"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expecting order %v, received %v", expected, order)
+	}
+}
+
+func TestSortedStrategy(t *testing.T) {
+	order := (SortedStrategy{}).Order(strategyCache())
+	if expected := []string{"foo.c", "foo.b", "foo.a", "foo.d"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expecting order %v, received %v", expected, order)
+	}
+}
+
+func TestNaiveStrategy(t *testing.T) {
+	order := (NaiveStrategy{}).Order(strategyCache())
+	sort.Strings(order)
+	if expected := []string{"foo.a", "foo.b", "foo.c", "foo.d"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expecting keys %v, received %v", expected, order)
+	}
+}
+
+func TestTimeSortedStrategy(t *testing.T) {
+	order := (TimeSortedStrategy{}).Order(strategyCache())
+	if expected := []string{"foo.c", "foo.d", "foo.b", "foo.a"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expecting order %v, received %v", expected, order)
+	}
+}
+
+func TestTimeSortedStrategyWithoutOldest(t *testing.T) {
+	// only the MetricCache methods, as when wrapped
+	cache := struct{ MetricCache }{strategyCache()}
+	order := (TimeSortedStrategy{}).Order(cache)
+	if expected := []string{"foo.c", "foo.d", "foo.b", "foo.a"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expecting order %v, received %v", expected, order)
+	}
+}
+
+func TestNewFlushStrategy(t *testing.T) {
+	for _, name := range []string{"max", "sorted", "naive", "timesorted"} {
+		if _, err := NewFlushStrategy(name); err != nil {
+			t.Fatalf("Expecting strategy %v to exist: %v", name, err)
+		}
+	}
+	if _, err := NewFlushStrategy("random"); err == nil {
+		t.Fatalf("Expecting an error for an unknown strategy")
+	}
+}
+
+type recordingSink struct {
+	lock sync.Mutex
+	keys []string
+	sent map[string][]DataPoint
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{sent: make(map[string][]DataPoint)}
+}
+
+func (sink *recordingSink) Send(key string, points []DataPoint) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.keys = append(sink.keys, key)
+	sink.sent[key] = append(sink.sent[key], points...)
+}
+
+func (sink *recordingSink) Keys() []string {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return append([]string(nil), sink.keys...)
+}
+
+func TestCacheBoltUsesStrategy(t *testing.T) {
+	cache := strategyCache()
+	sink := newRecordingSink()
+	NewCacheBolt(cache, sink, SortedStrategy{})
+	for i := 0; i < 100 && len(sink.Keys()) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if expected := []string{"foo.c", "foo.b", "foo.a", "foo.d"}; !reflect.DeepEqual(sink.Keys(), expected) {
+		t.Fatalf("Expecting order %v, received %v", expected, sink.Keys())
+	}
+}
@@ -0,0 +1,84 @@
+package silicon
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the default number of results from the autoComplete endpoints, as in graphite
+const autoCompleteLimit = 100
+
+/*
+	Serve graphite's TagDB HTTP API from the index, to be mounted at /tags/.
+	Parameters may be given in the query string or a form body.
+
+	/tags/tagSeries             path
+	/tags/delSeries             path (repeated)
+	/tags/findSeries            expr (repeated)
+	/tags/autoComplete/tags     tagPrefix, expr, limit
+	/tags/autoComplete/values   tag, valuePrefix, expr, limit
+*/
+func (index *TagIndex) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	var err error
+	switch {
+	case strings.HasSuffix(request.URL.Path, "/tagSeries"):
+		path := request.Form.Get("path")
+		if path == "" {
+			http.Error(response, "Missing path", http.StatusBadRequest)
+			return
+		}
+		result, err = index.Add(path)
+	case strings.HasSuffix(request.URL.Path, "/delSeries"):
+		paths := request.Form["path"]
+		if len(paths) == 0 {
+			http.Error(response, "Missing path", http.StatusBadRequest)
+			return
+		}
+		for _, path := range paths {
+			if err = index.Delete(path); err != nil {
+				break
+			}
+		}
+		result = true
+	case strings.HasSuffix(request.URL.Path, "/findSeries"):
+		result, err = index.FindSeries(request.Form["expr"])
+	case strings.HasSuffix(request.URL.Path, "/autoComplete/tags"):
+		var limit int
+		if limit, err = parseLimit(request.Form.Get("limit")); err == nil {
+			result, err = index.AutoCompleteTags(request.Form["expr"], request.Form.Get("tagPrefix"), limit)
+		}
+	case strings.HasSuffix(request.URL.Path, "/autoComplete/values"):
+		tag := request.Form.Get("tag")
+		if tag == "" {
+			http.Error(response, "Missing tag", http.StatusBadRequest)
+			return
+		}
+		var limit int
+		if limit, err = parseLimit(request.Form.Get("limit")); err == nil {
+			result, err = index.AutoCompleteValues(request.Form["expr"], tag, request.Form.Get("valuePrefix"), limit)
+		}
+	default:
+		http.NotFound(response, request)
+		return
+	}
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(result)
+}
+
+func parseLimit(value string) (int, error) {
+	if value == "" {
+		return autoCompleteLimit, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,395 @@
+package silicon
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	An index of tagged series kept in memory and persisted to a single
+	append-only file. Each line of the file adds (+) or deletes (-) a
+	series, the file is compacted when it is opened.
+*/
+type TagIndex struct {
+	path   string
+	lock   sync.RWMutex
+	file   *os.File
+	series map[string]map[string]string
+	// tag -> value -> keys
+	values map[string]map[string]map[string]bool
+}
+
+/*
+	Open the index at path, creating it if it does not exist.
+*/
+func OpenTagIndex(path string) (*TagIndex, error) {
+	index := new(TagIndex)
+	index.path = path
+	index.series = make(map[string]map[string]string)
+	index.values = make(map[string]map[string]map[string]bool)
+	if err := index.load(); err != nil {
+		return nil, err
+	}
+	if err := index.compact(); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func (index *TagIndex) load() error {
+	file, err := os.Open(index.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case '+':
+			if err := index.add(line[1:]); err != nil {
+				log.Printf("Skipping invalid tag index record: %v", err)
+			}
+		case '-':
+			index.remove(line[1:])
+		}
+	}
+	return scanner.Err()
+}
+
+/*
+	Rewrite the file with only the current series and open it for
+	appending.
+*/
+func (index *TagIndex) compact() error {
+	compactPath := index.path + ".compact"
+	file, err := os.Create(compactPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for key := range index.series {
+		writer.WriteString("+" + key + "\n")
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err := os.Rename(compactPath, index.path); err != nil {
+		return err
+	}
+	index.file, err = os.OpenFile(index.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+/*
+	Add a series to the index, returning its canonical key. Adding a series
+	that is already indexed does nothing.
+*/
+func (index *TagIndex) Add(key string) (string, error) {
+	key, err := canonicalKey(key)
+	if err != nil {
+		return "", err
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if _, found := index.series[key]; found {
+		return key, nil
+	}
+	if _, err := index.file.WriteString("+" + key + "\n"); err != nil {
+		return "", err
+	}
+	return key, index.add(key)
+}
+
+/*
+	Add key if it is a tagged series, for use as a writer callback.
+*/
+func (index *TagIndex) Observe(key string) {
+	if !isTagged(key) {
+		return
+	}
+	if _, err := index.Add(key); err != nil {
+		log.Printf("Failed to index %v: %v", key, err)
+	}
+}
+
+/*
+	Remove a series from the index. Removing a series that is not indexed
+	does nothing.
+*/
+func (index *TagIndex) Delete(key string) error {
+	key, err := canonicalKey(key)
+	if err != nil {
+		return err
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if _, found := index.series[key]; !found {
+		return nil
+	}
+	if _, err := index.file.WriteString("-" + key + "\n"); err != nil {
+		return err
+	}
+	index.remove(key)
+	return nil
+}
+
+/*
+	Return the canonical key of every indexed series.
+*/
+func (index *TagIndex) Series() []string {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	keys := make([]string, 0, len(index.series))
+	for key := range index.series {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (index *TagIndex) Close() error {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	return index.file.Close()
+}
+
+func (index *TagIndex) add(key string) error {
+	name, tags, err := parseTaggedKey(key)
+	if err != nil {
+		return err
+	}
+	tags["name"] = name
+	index.series[key] = tags
+	for tag, value := range tags {
+		if index.values[tag] == nil {
+			index.values[tag] = make(map[string]map[string]bool)
+		}
+		if index.values[tag][value] == nil {
+			index.values[tag][value] = make(map[string]bool)
+		}
+		index.values[tag][value][key] = true
+	}
+	return nil
+}
+
+func (index *TagIndex) remove(key string) {
+	for tag, value := range index.series[key] {
+		delete(index.values[tag][value], key)
+		if len(index.values[tag][value]) == 0 {
+			delete(index.values[tag], value)
+		}
+		if len(index.values[tag]) == 0 {
+			delete(index.values, tag)
+		}
+	}
+	delete(index.series, key)
+}
+
+/*
+	A parsed seriesByTag expression; tag=value, tag!=value, tag=~regex or
+	tag!=~regex. A missing tag has the value "".
+*/
+type tagExpression struct {
+	tag     string
+	value   string
+	pattern *regexp.Regexp
+	negate  bool
+}
+
+func parseTagExpression(expression string) (*tagExpression, error) {
+	index := strings.IndexAny(expression, "!=")
+	if index <= 0 {
+		return nil, fmt.Errorf("Invalid tag expression '%v'", expression)
+	}
+	result := &tagExpression{tag: expression[:index]}
+	operator := expression[index:]
+	if strings.HasPrefix(operator, "!") {
+		result.negate = true
+		operator = operator[1:]
+	}
+	if !strings.HasPrefix(operator, "=") {
+		return nil, fmt.Errorf("Invalid tag expression '%v'", expression)
+	}
+	operator = operator[1:]
+	if strings.HasPrefix(operator, "~") {
+		// as in graphite regular expressions match from the start
+		pattern := operator[1:]
+		if !strings.HasPrefix(pattern, "^") {
+			pattern = "^(?:" + pattern + ")"
+		}
+		var err error
+		if result.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid tag expression '%v': %v", expression, err)
+		}
+	} else {
+		result.value = operator
+	}
+	return result, nil
+}
+
+func (expression *tagExpression) matches(value string) bool {
+	var matched bool
+	if expression.pattern != nil {
+		matched = expression.pattern.MatchString(value)
+	} else {
+		matched = value == expression.value
+	}
+	return matched != expression.negate
+}
+
+func parseTagExpressions(expressions []string) ([]*tagExpression, error) {
+	result := make([]*tagExpression, len(expressions))
+	nonEmpty := false
+	for i, expression := range expressions {
+		parsed, err := parseTagExpression(expression)
+		if err != nil {
+			return nil, err
+		}
+		if !parsed.matches("") {
+			nonEmpty = true
+		}
+		result[i] = parsed
+	}
+	if !nonEmpty {
+		return nil, fmt.Errorf("At least one tag expression must match non-empty values")
+	}
+	return result, nil
+}
+
+/*
+	Return the sorted keys of every series matching all of the expressions,
+	at least one of which must not match an empty value.
+*/
+func (index *TagIndex) FindSeries(expressions []string) ([]string, error) {
+	parsed, err := parseTagExpressions(expressions)
+	if err != nil {
+		return nil, err
+	}
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	keys := index.findSeries(parsed)
+	sort.Strings(keys)
+	if keys == nil {
+		keys = []string{}
+	}
+	return keys, nil
+}
+
+func (index *TagIndex) findSeries(expressions []*tagExpression) []string {
+	var keys []string
+	for _, key := range index.candidates(expressions) {
+		tags := index.series[key]
+		matched := true
+		for _, expression := range expressions {
+			if !expression.matches(tags[expression.tag]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+/*
+	Narrow the series to check using the first exact match expression, if
+	there is one.
+*/
+func (index *TagIndex) candidates(expressions []*tagExpression) []string {
+	var keys []string
+	for _, expression := range expressions {
+		if expression.pattern == nil && !expression.negate && expression.value != "" {
+			for key := range index.values[expression.tag][expression.value] {
+				keys = append(keys, key)
+			}
+			return keys
+		}
+	}
+	for key := range index.series {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+/*
+	Return up to limit sorted tag names starting with prefix. If any
+	expressions are given only tags of matching series are returned.
+*/
+func (index *TagIndex) AutoCompleteTags(expressions []string, prefix string, limit int) ([]string, error) {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	found := make(map[string]bool)
+	if len(expressions) == 0 {
+		for tag := range index.values {
+			found[tag] = true
+		}
+	} else {
+		parsed, err := parseTagExpressions(expressions)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range index.findSeries(parsed) {
+			for tag := range index.series[key] {
+				found[tag] = true
+			}
+		}
+	}
+	return completions(found, prefix, limit), nil
+}
+
+/*
+	Return up to limit sorted values of tag starting with prefix. If any
+	expressions are given only values from matching series are returned.
+*/
+func (index *TagIndex) AutoCompleteValues(expressions []string, tag, prefix string, limit int) ([]string, error) {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	found := make(map[string]bool)
+	if len(expressions) == 0 {
+		for value := range index.values[tag] {
+			found[value] = true
+		}
+	} else {
+		parsed, err := parseTagExpressions(expressions)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range index.findSeries(parsed) {
+			if value, ok := index.series[key][tag]; ok {
+				found[value] = true
+			}
+		}
+	}
+	return completions(found, prefix, limit), nil
+}
+
+func completions(found map[string]bool, prefix string, limit int) []string {
+	result := make([]string, 0, len(found))
+	for value := range found {
+		if strings.HasPrefix(value, prefix) {
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
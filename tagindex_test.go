@@ -0,0 +1,169 @@
+package silicon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func openTestTagIndex(t *testing.T, dir string) *TagIndex {
+	index, err := OpenTagIndex(path.Join(dir, "tags.idx"))
+	if err != nil {
+		t.Fatalf("Failed to open tag index: %v", err)
+	}
+	for _, key := range []string{
+		"disk.used;host=web-1;dc=eu",
+		"disk.used;host=web-2;dc=us",
+		"disk.used;host=db-1;dc=eu;role=primary",
+		"cpu.used;host=web-1;dc=eu",
+	} {
+		if _, err := index.Add(key); err != nil {
+			t.Fatalf("Failed to add %v: %v", key, err)
+		}
+	}
+	return index
+}
+
+func TestTagIndexFindSeries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tagindex")
+	defer os.RemoveAll(dir)
+	index := openTestTagIndex(t, dir)
+	defer index.Close()
+
+	for _, test := range []struct {
+		expressions []string
+		expected    []string
+	}{
+		{[]string{"name=disk.used", "dc=eu"}, []string{"disk.used;dc=eu;host=db-1;role=primary", "disk.used;dc=eu;host=web-1"}},
+		{[]string{"name=disk.used", "dc!=eu"}, []string{"disk.used;dc=us;host=web-2"}},
+		{[]string{"host=~web"}, []string{"cpu.used;dc=eu;host=web-1", "disk.used;dc=eu;host=web-1", "disk.used;dc=us;host=web-2"}},
+		{[]string{"host=~web", "name!=~disk"}, []string{"cpu.used;dc=eu;host=web-1"}},
+		{[]string{"name=disk.used", "role="}, []string{"disk.used;dc=eu;host=web-1", "disk.used;dc=us;host=web-2"}},
+		{[]string{"host=~1$"}, []string{}},
+		{[]string{"dc=asia"}, []string{}},
+	} {
+		keys, err := index.FindSeries(test.expressions)
+		if err != nil {
+			t.Fatalf("Failed to find %v: %v", test.expressions, err)
+		}
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("Expecting %v to find %v, received %v", test.expressions, test.expected, keys)
+		}
+	}
+	for _, expressions := range [][]string{{"role="}, {"role!=web"}, {"host"}, {"=web"}} {
+		if _, err := index.FindSeries(expressions); err == nil {
+			t.Errorf("Expecting %v to be rejected", expressions)
+		}
+	}
+}
+
+func TestTagIndexAutoComplete(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tagindex")
+	defer os.RemoveAll(dir)
+	index := openTestTagIndex(t, dir)
+	defer index.Close()
+
+	tags, _ := index.AutoCompleteTags(nil, "", 0)
+	if !reflect.DeepEqual(tags, []string{"dc", "host", "name", "role"}) {
+		t.Errorf("Invalid tags %v", tags)
+	}
+	tags, _ = index.AutoCompleteTags([]string{"dc=us"}, "", 0)
+	if !reflect.DeepEqual(tags, []string{"dc", "host", "name"}) {
+		t.Errorf("Expecting only tags of matching series, received %v", tags)
+	}
+	values, _ := index.AutoCompleteValues(nil, "host", "web", 1)
+	if !reflect.DeepEqual(values, []string{"web-1"}) {
+		t.Errorf("Expecting the prefix and limit to apply, received %v", values)
+	}
+	values, _ = index.AutoCompleteValues([]string{"name=cpu.used"}, "host", "", 0)
+	if !reflect.DeepEqual(values, []string{"web-1"}) {
+		t.Errorf("Expecting only values of matching series, received %v", values)
+	}
+}
+
+func TestTagIndexPersists(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tagindex")
+	defer os.RemoveAll(dir)
+	index := openTestTagIndex(t, dir)
+	if err := index.Delete("disk.used;dc=us;host=web-2"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	index.Observe("untagged.series")
+	index.Close()
+
+	index, err := OpenTagIndex(path.Join(dir, "tags.idx"))
+	if err != nil {
+		t.Fatalf("Failed to reopen tag index: %v", err)
+	}
+	defer index.Close()
+	keys, _ := index.FindSeries([]string{"name=~."})
+	if len(keys) != 3 {
+		t.Fatalf("Expecting three series after reopening, received %v", keys)
+	}
+}
+
+func TestTagIndexServeHTTP(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tagindex")
+	defer os.RemoveAll(dir)
+	index := openTestTagIndex(t, dir)
+	defer index.Close()
+	server := httptest.NewServer(index)
+	defer server.Close()
+
+	get := func(path string, result interface{}) int {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to request %v: %v", path, err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusOK {
+			json.NewDecoder(response.Body).Decode(result)
+		}
+		return response.StatusCode
+	}
+
+	var tagged string
+	response, err := http.PostForm(server.URL+"/tags/tagSeries", url.Values{"path": {"mem.used;host=web-3;dc=us"}})
+	if err != nil {
+		t.Fatalf("Failed to tag series: %v", err)
+	}
+	json.NewDecoder(response.Body).Decode(&tagged)
+	response.Body.Close()
+	if tagged != "mem.used;dc=us;host=web-3" {
+		t.Fatalf("Expecting the canonical path, received %v", tagged)
+	}
+
+	var keys []string
+	get("/tags/findSeries?expr=dc%3Dus&expr=name%3Dmem.used", &keys)
+	if !reflect.DeepEqual(keys, []string{"mem.used;dc=us;host=web-3"}) {
+		t.Fatalf("Invalid series %v", keys)
+	}
+	var values []string
+	get("/tags/autoComplete/values?tag=host&valuePrefix=web-", &values)
+	if !reflect.DeepEqual(values, []string{"web-1", "web-2", "web-3"}) {
+		t.Fatalf("Invalid values %v", values)
+	}
+
+	response, err = http.PostForm(server.URL+"/tags/delSeries", url.Values{"path": {"mem.used;host=web-3;dc=us"}})
+	if err != nil {
+		t.Fatalf("Failed to delete series: %v", err)
+	}
+	response.Body.Close()
+	get("/tags/findSeries?expr=name%3Dmem.used", &keys)
+	if len(keys) != 0 {
+		t.Fatalf("Expecting the series to be deleted, received %v", keys)
+	}
+
+	if status := get("/tags/findSeries?expr=role%3D", &keys); status != http.StatusBadRequest {
+		t.Fatalf("Expecting an invalid expression to be a bad request, received %v", status)
+	}
+	if status := get("/tags/unknown", &keys); status != http.StatusNotFound {
+		t.Fatalf("Expecting an unknown endpoint to be not found, received %v", status)
+	}
+}
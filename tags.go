@@ -0,0 +1,97 @@
+package silicon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+	Graphite 1.1 tagged series have keys of the form
+	name;tag1=value1;tag2=value2. The canonical form has the tags sorted by
+	name so that the same series always has the same key.
+*/
+
+/*
+	True if the key is a tagged series.
+*/
+func isTagged(key string) bool {
+	return strings.Contains(key, ";")
+}
+
+/*
+	Split a tagged key into its name and tags. Tags are validated as carbon
+	does; names must not be empty and must not contain any of ;!^=, values
+	must not be empty, contain ; or start with ~. An untagged key is
+	returned as the name with no tags.
+*/
+func parseTaggedKey(key string) (string, map[string]string, error) {
+	parts := strings.Split(key, ";")
+	name := parts[0]
+	if name == "" {
+		return "", nil, fmt.Errorf("Invalid tagged series '%v', missing name", key)
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		index := strings.Index(part, "=")
+		if index < 0 {
+			return "", nil, fmt.Errorf("Invalid tag '%v' in '%v', expecting tag=value", part, key)
+		}
+		tag, value := part[:index], part[index+1:]
+		if tag == "" || strings.ContainsAny(tag, ";!^=") {
+			return "", nil, fmt.Errorf("Invalid tag name '%v' in '%v'", tag, key)
+		}
+		if value == "" || strings.HasPrefix(value, "~") {
+			return "", nil, fmt.Errorf("Invalid value '%v' for tag '%v' in '%v'", value, tag, key)
+		}
+		// as in carbon the name always comes from the path
+		if tag != "name" {
+			tags[tag] = value
+		}
+	}
+	return name, tags, nil
+}
+
+/*
+	Build the canonical key for a name and tags.
+*/
+func formatTaggedKey(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	parts := make([]string, 0, len(tags))
+	for tag, value := range tags {
+		parts = append(parts, tag+"="+value)
+	}
+	sort.Strings(parts)
+	return name + ";" + strings.Join(parts, ";")
+}
+
+/*
+	Return the canonical form of a key, untagged keys are returned as they
+	are.
+*/
+func canonicalKey(key string) (string, error) {
+	if !isTagged(key) {
+		return key, nil
+	}
+	name, tags, err := parseTaggedKey(key)
+	if err != nil {
+		return "", err
+	}
+	return formatTaggedKey(name, tags), nil
+}
+
+/*
+	Map a tagged key to its file under basePath using carbon's hashed
+	layout with TAG_HASH_FILENAMES; _tagged/<hash[0:3]>/<hash[3:6]>/<hash>.wsp
+	where hash is the hex SHA-256 of the canonical key.
+*/
+func taggedWhisperPath(basePath, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	return path.Join(basePath, "_tagged", hash[0:3], hash[3:6], hash+".wsp")
+}
@@ -0,0 +1,56 @@
+package silicon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"testing"
+)
+
+func TestCanonicalKey(t *testing.T) {
+	for key, expected := range map[string]string{
+		"disk.used":                    "disk.used",
+		"disk.used;host=a":             "disk.used;host=a",
+		"disk.used;host=a;dc=eu":       "disk.used;dc=eu;host=a",
+		"disk.used;name=other;host=a":  "disk.used;host=a",
+		"disk.used;path=a=b;host=a.b.": "disk.used;host=a.b.;path=a=b",
+	} {
+		canonical, err := canonicalKey(key)
+		if err != nil {
+			t.Fatalf("Failed to canonicalize %v: %v", key, err)
+		}
+		if canonical != expected {
+			t.Errorf("Expecting %v to be %v, received %v", key, expected, canonical)
+		}
+	}
+}
+
+func TestCanonicalKeyInvalid(t *testing.T) {
+	for _, key := range []string{
+		";host=a",
+		"disk.used;host",
+		"disk.used;=a",
+		"disk.used;host=",
+		"disk.used;ho!st=a",
+		"disk.used;host=~a",
+		"disk.used;host=a;",
+	} {
+		if _, err := canonicalKey(key); err == nil {
+			t.Errorf("Expecting %v to be invalid", key)
+		}
+	}
+}
+
+func TestTaggedWhisperPath(t *testing.T) {
+	sum := sha256.Sum256([]byte("disk.used;dc=eu;host=a"))
+	hash := hex.EncodeToString(sum[:])
+	expected := path.Join("/data", "_tagged", hash[:3], hash[3:6], hash+".wsp")
+	for _, key := range []string{"disk.used;dc=eu;host=a", "disk.used;host=a;dc=eu"} {
+		if fullPath := WhisperPath("/data", key); fullPath != expected {
+			t.Errorf("Expecting %v to be stored at %v, received %v", key, expected, fullPath)
+		}
+	}
+	if fullPath := WhisperPath("/data", "disk.used"); fullPath != "/data/disk/used.wsp" {
+		t.Errorf("Expecting untagged keys to be unchanged, received %v", fullPath)
+	}
+}
@@ -0,0 +1,233 @@
+package silicon
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Reasons a metric key is rejected, as reported by Rejected.
+*/
+const (
+	rejectEmpty            = "empty"
+	rejectEmptyNode        = "empty-node"
+	rejectIllegalCharacter = "illegal-character"
+	rejectTooLong          = "too-long"
+	rejectTooDeep          = "too-deep"
+	rejectNaN              = "nan"
+	rejectInfinite         = "infinite"
+	rejectTooOld           = "too-old"
+	rejectTooNew           = "too-new"
+	rejectTimestamp        = "invalid-timestamp"
+)
+
+// infinite values that were clamped rather than rejected are counted as
+const clampedInfinite = "clamped-infinite"
+
+/*
+	A MetricCache that checks each metric before storing it. Keys become
+	file paths so anything that could escape the data directory is
+	rejected; empty nodes (leading, trailing or repeated dots), path
+	separators and control characters. Illegal characters can instead be
+	replaced. Points with a value that is not a number or a timestamp that
+	Whisper cannot store, or that falls outside the configured window, are
+	also rejected.
+*/
+type validatingCache struct {
+	MetricCache
+	maxLength int
+	maxDepth  int
+	sanitize  bool
+
+	clampInfinite bool
+	maxAge        time.Duration
+	maxFuture     time.Duration
+	acceptNow     bool
+
+	lock     sync.Mutex
+	rejected map[string]int
+}
+
+/*
+	Create a validating cache in front of cache. A maxLength or maxDepth of
+	zero is unlimited. If sanitize is true illegal characters are replaced
+	with an underscore rather than the metric being rejected.
+*/
+func NewValidatingCache(cache MetricCache, maxLength, maxDepth int, sanitize bool) *validatingCache {
+	return &validatingCache{
+		MetricCache: cache,
+		maxLength:   maxLength,
+		maxDepth:    maxDepth,
+		sanitize:    sanitize,
+		acceptNow:   true,
+		rejected:    make(map[string]int),
+	}
+}
+
+/*
+	Set the rules for data points. Infinite values are clamped to the
+	largest float rather than rejected if clampInfinite is true, NaN is
+	always rejected. Points older than maxAge or further than maxFuture
+	ahead of now are rejected, zero is unlimited. A timestamp of -1 or "N"
+	is taken as now if acceptNow is true. Must be called before the first
+	Store.
+*/
+func (cache *validatingCache) SetPointRules(clampInfinite bool, maxAge, maxFuture time.Duration, acceptNow bool) {
+	cache.clampInfinite = clampInfinite
+	cache.maxAge = maxAge
+	cache.maxFuture = maxFuture
+	cache.acceptNow = acceptNow
+}
+
+func (cache *validatingCache) Store(metric *Metric) {
+	key, reason := cache.validate(metric.key)
+	if reason != "" {
+		cache.reject(reason, "Rejected metric key %q: %v", metric.key, reason)
+		return
+	}
+	point, clamped, reason := cache.checkPoint(metric.DataPoint)
+	if reason != "" {
+		cache.reject(reason, "Rejected point for %v: %v (%v)", metric.key, reason, metric)
+		return
+	}
+	if clamped {
+		cache.count(clampedInfinite)
+	}
+	if key != metric.key || point != metric.DataPoint {
+		metric = &Metric{key, point}
+	}
+	cache.MetricCache.Store(metric)
+}
+
+func (cache *validatingCache) reject(reason string, format string, args ...interface{}) {
+	cache.count(reason)
+	log.Printf(format, args...)
+}
+
+func (cache *validatingCache) count(reason string) {
+	cache.lock.Lock()
+	cache.rejected[reason]++
+	cache.lock.Unlock()
+}
+
+/*
+	Return the number of metrics rejected for each reason, along with the
+	number of infinite values clamped.
+*/
+func (cache *validatingCache) Rejected() map[string]int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	result := make(map[string]int, len(cache.rejected))
+	for reason, count := range cache.rejected {
+		result[reason] = count
+	}
+	return result
+}
+
+/*
+	Return the key to store, which may have been sanitized, or the reason
+	it was rejected.
+*/
+func (cache *validatingCache) validate(key string) (string, string) {
+	if key == "" {
+		return "", rejectEmpty
+	}
+	if strings.IndexFunc(key, illegalKeyRune) >= 0 {
+		if !cache.sanitize {
+			return "", rejectIllegalCharacter
+		}
+		key = strings.Map(func(r rune) rune {
+			if illegalKeyRune(r) {
+				return '_'
+			}
+			return r
+		}, key)
+		// replacing characters can change the order of the tags
+		if canonical, err := canonicalKey(key); err == nil {
+			key = canonical
+		}
+	}
+	if cache.maxLength > 0 && len(key) > cache.maxLength {
+		return "", rejectTooLong
+	}
+	// tagged series are stored by hash so only the name becomes a path
+	name := key
+	if isTagged(key) {
+		name = key[:strings.Index(key, ";")]
+	}
+	nodes := strings.Split(name, ".")
+	if cache.maxDepth > 0 && len(nodes) > cache.maxDepth {
+		return "", rejectTooDeep
+	}
+	for _, node := range nodes {
+		if node == "" {
+			return "", rejectEmptyNode
+		}
+	}
+	return key, ""
+}
+
+/*
+	Return an error if key would have been rejected at ingest. Queried keys
+	are checked before they become file paths so that they cannot reach
+	outside the data directory.
+*/
+func checkQueryKey(key string) error {
+	if _, reason := new(validatingCache).validate(key); reason != "" {
+		return fmt.Errorf("Invalid metric key '%v': %v", key, reason)
+	}
+	return nil
+}
+
+/*
+	Return the point to store, or the reason it was rejected. The point may
+	have had its timestamp resolved or its value clamped.
+*/
+func (cache *validatingCache) checkPoint(point DataPoint) (DataPoint, bool, string) {
+	clamped := false
+	if math.IsNaN(point.value) {
+		return point, false, rejectNaN
+	}
+	if math.IsInf(point.value, 0) {
+		if !cache.clampInfinite {
+			return point, false, rejectInfinite
+		}
+		point.value = math.Copysign(math.MaxFloat64, point.value)
+		clamped = true
+	}
+
+	now := time.Now()
+	if point.timestamp == nowTimestamp && cache.acceptNow {
+		point.timestamp = now.Unix()
+	}
+	if !whisperTimestamp(point.timestamp) {
+		return point, false, rejectTimestamp
+	}
+	if cache.maxAge > 0 && point.timestamp < now.Add(-cache.maxAge).Unix() {
+		return point, false, rejectTooOld
+	}
+	if cache.maxFuture > 0 && point.timestamp > now.Add(cache.maxFuture).Unix() {
+		return point, false, rejectTooNew
+	}
+	return point, clamped, ""
+}
+
+/*
+	Whisper stores timestamps as unsigned 32 bit integers, zero marks an
+	empty slot.
+*/
+func whisperTimestamp(timestamp int64) bool {
+	return timestamp > 0 && timestamp <= math.MaxUint32
+}
+
+/*
+	Characters that cannot appear in a key; path separators, spaces, control
+	characters and invalid UTF-8.
+*/
+func illegalKeyRune(r rune) bool {
+	return r == '/' || r == '\\' || r == ' ' || r < 0x20 || r == 0x7f || r == 0xfffd
+}
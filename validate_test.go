@@ -0,0 +1,109 @@
+package silicon
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestValidatingCacheRejectsKeys(t *testing.T) {
+	cache := NewValidatingCache(NewMetricCache(), 20, 3, false)
+	defer cache.Close()
+	for key, reason := range map[string]string{
+		"":                       rejectEmpty,
+		"../../etc/passwd":       rejectIllegalCharacter,
+		"foo/bar":                rejectIllegalCharacter,
+		"foo bar":                rejectIllegalCharacter,
+		"foo\x00bar":             rejectIllegalCharacter,
+		".foo.bar":               rejectEmptyNode,
+		"foo..bar":               rejectEmptyNode,
+		"foo.bar.":               rejectEmptyNode,
+		"..":                     rejectEmptyNode,
+		"foo.bar.baz.qux":        rejectTooDeep,
+		"foo.abcdefghijklmnopqr": rejectTooLong,
+	} {
+		cache.Store(&Metric{key, DataPoint{1, 1}})
+		if rejected := cache.Rejected(); rejected[reason] != 1 {
+			t.Errorf("Expecting %q to be rejected as %v, received %v", key, reason, rejected)
+		}
+		cache.rejected = make(map[string]int)
+	}
+	if cache.Size() != 0 {
+		t.Fatalf("Expecting no metrics to be stored, received %v", cache.Counts())
+	}
+
+	cache.Store(&Metric{"foo.bar-baz_1", DataPoint{1, 1}})
+	// only the name of a tagged series counts towards the depth
+	cache.Store(&Metric{"a.b;h=c.d.e;x=1.", DataPoint{1, 1}})
+	if cache.Size() != 2 {
+		t.Fatalf("Expecting valid keys to be stored, received %v", cache.Rejected())
+	}
+}
+
+func TestValidatingCacheSanitizes(t *testing.T) {
+	cache := NewValidatingCache(NewMetricCache(), 0, 0, true)
+	defer cache.Close()
+	cache.Store(&Metric{"foo bar/baz", DataPoint{1, 1}})
+	if points := cache.Get("foo_bar_baz"); len(points) != 1 {
+		t.Fatalf("Expecting the key to be sanitized, received %v", cache.Counts())
+	}
+
+	// sanitizing must not make traversal possible
+	cache.Store(&Metric{"../../etc/passwd", DataPoint{1, 1}})
+	if rejected := cache.Rejected(); rejected[rejectEmptyNode] != 1 || cache.Size() != 1 {
+		t.Fatalf("Expecting a traversing key to be rejected, received %v", rejected)
+	}
+}
+
+func TestValidatingCacheRejectsPoints(t *testing.T) {
+	cache := NewValidatingCache(NewMetricCache(), 0, 0, false)
+	defer cache.Close()
+	cache.SetPointRules(false, time.Hour, time.Minute, false)
+	now := time.Now().Unix()
+	for _, rejected := range []struct {
+		point  DataPoint
+		reason string
+	}{
+		{DataPoint{math.NaN(), now}, rejectNaN},
+		{DataPoint{math.Inf(1), now}, rejectInfinite},
+		{DataPoint{math.Inf(-1), now}, rejectInfinite},
+		{DataPoint{1, now - 7200}, rejectTooOld},
+		{DataPoint{1, now + 3600}, rejectTooNew},
+		{DataPoint{1, -5}, rejectTimestamp},
+		{DataPoint{1, nowTimestamp}, rejectTimestamp},
+		{DataPoint{1, 1 << 33}, rejectTimestamp},
+	} {
+		cache.Store(&Metric{"foo.bar", rejected.point})
+		if counts := cache.Rejected(); counts[rejected.reason] != 1 {
+			t.Errorf("Expecting %v to be rejected as %v, received %v", rejected.point, rejected.reason, counts)
+		}
+		cache.rejected = make(map[string]int)
+	}
+	if cache.Size() != 0 {
+		t.Fatalf("Expecting no points to be stored, received %v", cache.Get("foo.bar"))
+	}
+
+	cache.Store(&Metric{"foo.bar", DataPoint{1, now - 60}})
+	if cache.Size() != 1 {
+		t.Fatalf("Expecting a point inside the window to be stored")
+	}
+}
+
+func TestValidatingCacheClampsAndResolvesNow(t *testing.T) {
+	cache := NewValidatingCache(NewMetricCache(), 0, 0, false)
+	defer cache.Close()
+	cache.SetPointRules(true, 0, 0, true)
+	before := time.Now().Unix()
+	cache.Store(&Metric{"foo.bar", DataPoint{math.Inf(-1), nowTimestamp}})
+
+	points := cache.Get("foo.bar")
+	if len(points) != 1 || points[0].value != -math.MaxFloat64 {
+		t.Fatalf("Expecting the value to be clamped, received %v", points)
+	}
+	if points[0].timestamp < before || points[0].timestamp > time.Now().Unix() {
+		t.Fatalf("Expecting the timestamp to be now, received %v", points[0].timestamp)
+	}
+	if counts := cache.Rejected(); counts[clampedInfinite] != 1 {
+		t.Fatalf("Expecting the clamp to be counted, received %v", counts)
+	}
+}
@@ -0,0 +1,267 @@
+package silicon
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+	An append-only write-ahead log of metrics accepted into the cache. The
+	log is split into segments, a segment is removed once every point in it
+	has been confirmed as persisted by the writer. Records are written with
+	unbuffered writes so that they survive the process being killed.
+*/
+type WAL struct {
+	dir         string
+	segmentSize int64
+	lock        sync.Mutex
+	current     *walSegment
+	segments    []*walSegment
+}
+
+type walSegment struct {
+	index   int
+	file    *os.File
+	size    int64
+	pending map[string]int // unconfirmed points per key
+	total   int
+	loaded  bool // false for segments from a previous run until replayed
+}
+
+/*
+	Open the write-ahead log in dir, creating it if necessary. Segments are
+	rotated once they reach segmentSize bytes. Existing segments are kept
+	until Replay is called.
+*/
+func OpenWAL(dir string, segmentSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return nil, fmt.Errorf("WAL error: %v", err)
+	}
+	wal := &WAL{dir: dir, segmentSize: segmentSize}
+	indexes, err := wal.segmentIndexes()
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		wal.segments = append(wal.segments, &walSegment{index: index, pending: make(map[string]int)})
+	}
+	next := 0
+	if len(indexes) > 0 {
+		next = indexes[len(indexes)-1] + 1
+	}
+	if err := wal.rotate(next); err != nil {
+		return nil, err
+	}
+
+	return wal, nil
+}
+
+/*
+	Replay every existing segment into cache, this should be the underlying
+	cache rather than a walCache so points are not logged twice. Replayed
+	points stay in the log until they are confirmed, which can happen while
+	replaying if the cache is being flushed.
+*/
+func (wal *WAL) Replay(cache MetricCache) (int, error) {
+	wal.lock.Lock()
+	// confirming can remove segments from the list
+	segments := append([]*walSegment(nil), wal.segments...)
+	current := wal.current
+	wal.lock.Unlock()
+	count := 0
+	for _, segment := range segments {
+		if segment == current {
+			continue
+		}
+		file, err := os.Open(wal.segmentPath(segment.index))
+		if err != nil {
+			return count, fmt.Errorf("WAL replay error: %v", err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			metric, err := ParseLineMetric(scanner.Text())
+			if err != nil {
+				// most likely a partial record from a crash
+				log.Printf("Skipping invalid WAL record in segment %v: %v", segment.index, err)
+				continue
+			}
+			// counted before storing as it may be confirmed straight away
+			wal.lock.Lock()
+			segment.pending[metric.key]++
+			segment.total++
+			wal.lock.Unlock()
+			cache.Store(metric)
+			count++
+		}
+		err = scanner.Err()
+		file.Close()
+		wal.lock.Lock()
+		segment.loaded = true
+		wal.removeConfirmed()
+		wal.lock.Unlock()
+		if err != nil {
+			return count, fmt.Errorf("WAL replay error: %v", err)
+		}
+	}
+
+	return count, nil
+}
+
+/*
+	Append a metric to the log.
+*/
+func (wal *WAL) Append(metric *Metric) error {
+	record := formatLineMetric(metric) + "\n"
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.current.size >= wal.segmentSize {
+		if err := wal.rotate(wal.current.index + 1); err != nil {
+			return err
+		}
+	}
+	n, err := wal.current.file.WriteString(record)
+	wal.current.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("WAL write error: %v", err)
+	}
+	wal.current.pending[metric.key]++
+	wal.current.total++
+
+	return nil
+}
+
+/*
+	Confirm that count points for key have been persisted. Points are
+	confirmed oldest first and segments with nothing left pending are
+	removed.
+*/
+func (wal *WAL) Confirm(key string, count int) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	for _, segment := range wal.segments {
+		if count == 0 {
+			break
+		}
+		pending := segment.pending[key]
+		if pending == 0 {
+			continue
+		}
+		if pending > count {
+			pending = count
+		}
+		segment.pending[key] -= pending
+		if segment.pending[key] == 0 {
+			delete(segment.pending, key)
+		}
+		segment.total -= pending
+		count -= pending
+	}
+	wal.removeConfirmed()
+}
+
+/*
+	Close the current segment. Unconfirmed segments are left on disk to be
+	replayed on the next start.
+*/
+func (wal *WAL) Close() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if err := wal.current.file.Sync(); err != nil {
+		return err
+	}
+	return wal.current.file.Close()
+}
+
+func (wal *WAL) rotate(index int) error {
+	file, err := os.OpenFile(wal.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("WAL error: %v", err)
+	}
+	if wal.current != nil {
+		wal.current.file.Sync()
+		wal.current.file.Close()
+		wal.current.file = nil
+	}
+	wal.current = &walSegment{index: index, file: file, pending: make(map[string]int), loaded: true}
+	wal.segments = append(wal.segments, wal.current)
+	wal.removeConfirmed()
+
+	return nil
+}
+
+func (wal *WAL) removeConfirmed() {
+	remaining := wal.segments[:0]
+	for _, segment := range wal.segments {
+		if segment.loaded && segment.total == 0 && segment != wal.current {
+			if err := os.Remove(wal.segmentPath(segment.index)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove WAL segment %v: %v", segment.index, err)
+			}
+		} else {
+			remaining = append(remaining, segment)
+		}
+	}
+	wal.segments = remaining
+}
+
+func (wal *WAL) segmentPath(index int) string {
+	return path.Join(wal.dir, fmt.Sprintf("%010d.wal", index))
+}
+
+func (wal *WAL) segmentIndexes() ([]int, error) {
+	matches, err := filepath.Glob(path.Join(wal.dir, "*.wal"))
+	if err != nil {
+		return nil, fmt.Errorf("WAL error: %v", err)
+	}
+	indexes := make([]int, 0, len(matches))
+	for _, match := range matches {
+		name := path.Base(match)
+		index, err := strconv.Atoi(name[:len(name)-len(".wal")])
+		if err == nil {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+/*
+	A MetricCache that writes every metric through a WAL before storing it
+	in the underlying cache.
+*/
+type walCache struct {
+	MetricCache
+	wal *WAL
+}
+
+// caches that report the points they drop, see metricCache.OnDropped
+type dropReporter interface {
+	OnDropped(func(string, int))
+}
+
+/*
+	Create a cache that appends each metric to wal before storing it in
+	cache. Points the cache drops are confirmed so that they are not kept
+	in the log, and replayed, forever. This includes points replayed
+	straight into cache, so it must be called before Replay.
+*/
+func NewWALCache(cache MetricCache, wal *WAL) *walCache {
+	if reporter, ok := cache.(dropReporter); ok {
+		reporter.OnDropped(wal.Confirm)
+	}
+	return &walCache{cache, wal}
+}
+
+func (cache *walCache) Store(metric *Metric) {
+	if err := cache.wal.Append(metric); err != nil {
+		log.Printf("Failed to append to WAL: %v", err)
+	}
+	cache.MetricCache.Store(metric)
+}
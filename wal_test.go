@@ -0,0 +1,108 @@
+package silicon
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+const walPath = "/tmp/silicon-wal"
+
+func walSegments(t *testing.T) []string {
+	matches, err := filepath.Glob(walPath + "/*.wal")
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	return matches
+}
+
+func TestWALReplay(t *testing.T) {
+	assertFileNotExists(t, walPath)
+	defer tearDown(walPath)
+
+	wal, err := OpenWAL(walPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	cache := NewWALCache(NewMetricCache(), wal)
+	cache.Store(&Metric{"foo.bar", DataPoint{1.5, 1234}})
+	cache.Store(&Metric{"foo.baz", DataPoint{2, 1235}})
+	wal.Close()
+
+	wal, err = OpenWAL(walPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+	replayed := NewMetricCache()
+	count, err := wal.Replay(replayed)
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if count != 2 || replayed.Size() != 2 {
+		t.Fatalf("Expecting 2 replayed points, received %v", count)
+	}
+	if points := replayed.Pop("foo.bar"); len(points) != 1 || points[0].value != 1.5 || points[0].timestamp != 1234 {
+		t.Fatalf("Invalid replayed points %v", points)
+	}
+}
+
+func TestWALConfirmRemovesSegments(t *testing.T) {
+	assertFileNotExists(t, walPath)
+	defer tearDown(walPath)
+
+	wal, err := OpenWAL(walPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer wal.Close()
+	wal.Append(&Metric{"foo.bar", DataPoint{1, 1234}})
+	wal.Append(&Metric{"foo.bar", DataPoint{2, 1235}})
+	wal.Append(&Metric{"foo.baz", DataPoint{3, 1236}})
+	if length := len(walSegments(t)); length != 3 {
+		t.Fatalf("Expecting 3 segments after rotation, received %v", length)
+	}
+
+	wal.Confirm("foo.bar", 2)
+	if length := len(walSegments(t)); length != 1 {
+		t.Fatalf("Expecting confirmed segments to be removed, received %v", length)
+	}
+}
+
+func TestWALKeepsUnreplayedSegments(t *testing.T) {
+	assertFileNotExists(t, walPath)
+	defer tearDown(walPath)
+
+	wal, _ := OpenWAL(walPath, 10)
+	wal.Append(&Metric{"foo.bar", DataPoint{1, 1234}})
+	wal.Append(&Metric{"foo.bar", DataPoint{2, 1235}})
+	wal.Close()
+
+	wal, _ = OpenWAL(walPath, 10)
+	defer wal.Close()
+	wal.Append(&Metric{"foo.baz", DataPoint{3, 1236}})
+	wal.Append(&Metric{"foo.baz", DataPoint{4, 1237}})
+	wal.Confirm("foo.baz", 2)
+	if length := len(walSegments(t)); length != 3 {
+		t.Fatalf("Expecting segments from a previous run to be kept until replayed, received %v", length)
+	}
+}
+
+func TestWALConfirmsDroppedPoints(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest} {
+		assertFileNotExists(t, walPath)
+		wal, _ := OpenWAL(walPath, 10)
+		bounded := NewBoundedMetricCache(2, 0, policy)
+		cache := NewWALCache(bounded, wal)
+		for i := 0; i < 5; i++ {
+			cache.Store(&Metric{"foo.bar", DataPoint{float64(i), int64(1234 + i)}})
+		}
+		cache.Store(&Metric{"foo.baz", DataPoint{5, 1240}})
+		// the points kept are persisted as usual
+		wal.Confirm("foo.bar", len(bounded.Pop("foo.bar")))
+		if length := len(walSegments(t)); length != 1 {
+			t.Errorf("Expecting only the current segment to be left with %v, received %v", policy, length)
+		}
+		wal.Close()
+		tearDown(walPath)
+	}
+}
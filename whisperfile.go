@@ -0,0 +1,287 @@
+package silicon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/robyoung/go-whisper"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+	Maintenance operations on Whisper files, these mirror the scripts that
+	ship with Python whisper.
+*/
+
+const whisperPointSize = 12
+
+/*
+	Write a summary of the file's metadata and archives in the format of
+	whisper-info.py.
+*/
+func WriteWhisperInfo(path string, out io.Writer) error {
+	header, err := readWhisperHeader(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "aggregationMethod: %v\n", aggregationMethodName(header.aggregationMethod))
+	fmt.Fprintf(out, "maxRetention: %v\n", header.maxRetention)
+	fmt.Fprintf(out, "xFilesFactor: %v\n", header.xFilesFactor)
+	fmt.Fprintf(out, "fileSize: %v\n", info.Size())
+	for i, archive := range header.archives {
+		fmt.Fprintf(out, "\nArchive %v\n", i)
+		fmt.Fprintf(out, "retention: %v\n", archive.secondsPerPoint*archive.points)
+		fmt.Fprintf(out, "secondsPerPoint: %v\n", archive.secondsPerPoint)
+		fmt.Fprintf(out, "points: %v\n", archive.points)
+		fmt.Fprintf(out, "size: %v\n", archive.points*whisperPointSize)
+		fmt.Fprintf(out, "offset: %v\n", archive.offset)
+	}
+	return nil
+}
+
+/*
+	Write the metadata and every raw slot of every archive in the format of
+	whisper-dump.py.
+*/
+func DumpWhisper(path string, out io.Writer) error {
+	header, err := readWhisperHeader(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintf(out, "Meta data:\n")
+	fmt.Fprintf(out, "  aggregation method: %v\n", aggregationMethodName(header.aggregationMethod))
+	fmt.Fprintf(out, "  max retention: %v\n", header.maxRetention)
+	fmt.Fprintf(out, "  xFilesFactor: %v\n", header.xFilesFactor)
+	for i, archive := range header.archives {
+		fmt.Fprintf(out, "\nArchive %v info:\n", i)
+		fmt.Fprintf(out, "  offset: %v\n", archive.offset)
+		fmt.Fprintf(out, "  seconds per point: %v\n", archive.secondsPerPoint)
+		fmt.Fprintf(out, "  points: %v\n", archive.points)
+		fmt.Fprintf(out, "  retention: %v\n", archive.secondsPerPoint*archive.points)
+		fmt.Fprintf(out, "  size: %v\n", archive.points*whisperPointSize)
+	}
+	for i, archive := range header.archives {
+		slots, err := readWhisperArchive(file, archive)
+		if err != nil {
+			return fmt.Errorf("Failed to read archive %v: %v", i, err)
+		}
+		fmt.Fprintf(out, "\nArchive %v data:\n", i)
+		for j, slot := range slots {
+			fmt.Fprintf(out, "%v: %v, %v\n", j, slot.Time, slot.Value)
+		}
+	}
+	return nil
+}
+
+/*
+	Return the aggregation method and xFilesFactor a file was created with.
+*/
+func WhisperAggregation(path string) (whisper.AggregationMethod, float32, error) {
+	header, err := readWhisperHeader(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return header.aggregationMethod, header.xFilesFactor, nil
+}
+
+/*
+	Rewrite the header of an existing file with a new aggregation method and
+	xFilesFactor. Points already aggregated are left as they are.
+*/
+func SetWhisperAggregation(path string, aggregationMethod whisper.AggregationMethod, xFilesFactor float32) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 4)
+	binary.BigEndian.PutUint32(buffer, uint32(aggregationMethod))
+	if _, err := file.WriteAt(buffer, 0); err != nil {
+		file.Close()
+		return err
+	}
+	binary.BigEndian.PutUint32(buffer, math.Float32bits(xFilesFactor))
+	if _, err := file.WriteAt(buffer, 8); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+	Replace a file with one using new retentions, copying across the points
+	from every archive as whisper-resize.py does. The new file is built
+	alongside and renamed over the old one.
+*/
+func ResizeWhisper(path string, retentions whisper.Retentions, aggregationMethod whisper.AggregationMethod, xFilesFactor float32) error {
+	_, archives, err := readWhisperPoints(path)
+	if err != nil {
+		return err
+	}
+
+	resizedPath := path + ".resize"
+	os.Remove(resizedPath)
+	resized, err := whisper.Create(resizedPath, retentions, aggregationMethod, xFilesFactor)
+	if err != nil {
+		return err
+	}
+	err = writeWhisperPoints(resized, archives)
+	resized.Close()
+	if err != nil {
+		os.Remove(resizedPath)
+		return err
+	}
+
+	return os.Rename(resizedPath, path)
+}
+
+/*
+	Copy every point in from into to, overwriting what is there, as
+	whisper-merge.py does.
+*/
+func MergeWhisper(from, to string) error {
+	_, archives, err := readWhisperPoints(from)
+	if err != nil {
+		return err
+	}
+	file, err := whisper.Open(to)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return writeWhisperPoints(file, archives)
+}
+
+/*
+	Copy the points in from into to only where to has no value, as
+	whisper-fill.py does. Useful for backfilling gaps after an outage.
+*/
+func FillWhisper(from, to string) error {
+	_, archives, err := readWhisperPoints(from)
+	if err != nil {
+		return err
+	}
+	toHeader, toArchives, err := readWhisperPoints(to)
+	if err != nil {
+		return err
+	}
+	filled := make([]map[int]bool, len(toArchives))
+	for i, points := range toArchives {
+		filled[i] = make(map[int]bool, len(points))
+		for _, point := range points {
+			filled[i][point.Time] = true
+		}
+	}
+
+	now := int(time.Now().Unix())
+	gaps := make([][]*whisper.TimeSeriesPoint, len(archives))
+	for i, points := range archives {
+		for _, point := range points {
+			// the point lands in the highest precision archive that covers it
+			for j, archive := range toHeader.archives {
+				if point.Time > now-archive.secondsPerPoint*archive.points {
+					if !filled[j][point.Time-point.Time%archive.secondsPerPoint] {
+						gaps[i] = append(gaps[i], point)
+					}
+					break
+				}
+			}
+		}
+	}
+
+	file, err := whisper.Open(to)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return writeWhisperPoints(file, gaps)
+}
+
+/*
+	Read the raw slots of an archive. Slots that have never been written or
+	that have expired are returned as they are on disk.
+*/
+func readWhisperArchive(file *os.File, archive whisperArchiveInfo) ([]whisper.TimeSeriesPoint, error) {
+	buffer := make([]byte, archive.points*whisperPointSize)
+	if _, err := file.ReadAt(buffer, int64(archive.offset)); err != nil {
+		return nil, err
+	}
+	slots := make([]whisper.TimeSeriesPoint, archive.points)
+	for i := range slots {
+		slot := buffer[i*whisperPointSize:]
+		slots[i] = whisper.TimeSeriesPoint{
+			Time:  int(binary.BigEndian.Uint32(slot[0:4])),
+			Value: math.Float64frombits(binary.BigEndian.Uint64(slot[4:12])),
+		}
+	}
+	return slots, nil
+}
+
+/*
+	Read the points still within the retention of each archive, highest
+	precision archive first and each in time order.
+*/
+func readWhisperPoints(path string) (*whisperHeader, [][]*whisper.TimeSeriesPoint, error) {
+	header, err := readWhisperHeader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	now := int(time.Now().Unix())
+	archives := make([][]*whisper.TimeSeriesPoint, len(header.archives))
+	for i, archive := range header.archives {
+		slots, err := readWhisperArchive(file, archive)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read archive %v of %v: %v", i, path, err)
+		}
+		for j := range slots {
+			if slots[j].Time > now-archive.secondsPerPoint*archive.points && !math.IsNaN(slots[j].Value) {
+				archives[i] = append(archives[i], &slots[j])
+			}
+		}
+		sort.Sort(pointsByTime(archives[i]))
+	}
+
+	return header, archives, nil
+}
+
+/*
+	Write points read by readWhisperPoints. The coarsest archive is written
+	first so that finer points overwrite the aggregates built from it.
+*/
+func writeWhisperPoints(file *whisper.Whisper, archives [][]*whisper.TimeSeriesPoint) error {
+	for i := len(archives) - 1; i >= 0; i-- {
+		if len(archives[i]) == 0 {
+			continue
+		}
+		if err := file.UpdateMany(archives[i]); err != nil {
+			return fmt.Errorf("Failed to write archive %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+type pointsByTime []*whisper.TimeSeriesPoint
+
+func (p pointsByTime) Len() int           { return len(p) }
+func (p pointsByTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p pointsByTime) Less(i, j int) bool { return p[i].Time < p[j].Time }
@@ -0,0 +1,111 @@
+package silicon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/robyoung/go-whisper"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	Write a file with a single archive holding the given slots.
+*/
+func writeWhisperFile(t *testing.T, filePath string, secondsPerPoint int, slots []whisper.TimeSeriesPoint) {
+	writeWhisperHeader(t, filePath, whisper.Average, 0.5, whisperArchiveInfo{28, secondsPerPoint, len(slots)})
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+	for _, slot := range slots {
+		binary.Write(file, binary.BigEndian, uint32(slot.Time))
+		binary.Write(file, binary.BigEndian, slot.Value)
+	}
+}
+
+func TestReadWhisperPoints(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "whisperfile")
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "foo.wsp")
+	now := int(time.Now().Unix())
+	now -= now % 60
+	writeWhisperFile(t, filePath, 60, []whisper.TimeSeriesPoint{
+		{Time: now, Value: 3}, {Time: 0, Value: 0}, {Time: now - 120, Value: 1}, {Time: now - 3600, Value: 9}, {Time: now - 60, Value: math.NaN()},
+	})
+
+	_, archives, err := readWhisperPoints(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read points: %v", err)
+	}
+	if len(archives) != 1 || len(archives[0]) != 2 {
+		t.Fatalf("Expecting only the live points, received %v", archives)
+	}
+	if *archives[0][0] != (whisper.TimeSeriesPoint{Time: now - 120, Value: 1}) || *archives[0][1] != (whisper.TimeSeriesPoint{Time: now, Value: 3}) {
+		t.Fatalf("Expecting points in time order, received %v %v", archives[0][0], archives[0][1])
+	}
+}
+
+func TestWriteWhisperInfoAndDump(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "whisperfile")
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "foo.wsp")
+	writeWhisperFile(t, filePath, 60, []whisper.TimeSeriesPoint{{Time: 1380000000, Value: 1.5}, {Time: 0, Value: 0}})
+
+	info := new(bytes.Buffer)
+	if err := WriteWhisperInfo(filePath, info); err != nil {
+		t.Fatalf("Failed to write info: %v", err)
+	}
+	for _, line := range []string{"aggregationMethod: average", "maxRetention: 120", "fileSize: 52", "secondsPerPoint: 60"} {
+		if !strings.Contains(info.String(), line+"\n") {
+			t.Errorf("Expecting info to contain '%v', received\n%v", line, info)
+		}
+	}
+
+	dump := new(bytes.Buffer)
+	if err := DumpWhisper(filePath, dump); err != nil {
+		t.Fatalf("Failed to dump: %v", err)
+	}
+	if !strings.HasSuffix(dump.String(), "Archive 0 data:\n0: 1380000000, 1.5\n1: 0, 0\n") {
+		t.Errorf("Expecting every slot to be dumped, received\n%v", dump)
+	}
+}
+
+func TestFillWhisper(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "whisperfile")
+	defer os.RemoveAll(dir)
+	retentions, _ := whisper.ParseRetentionDefs("1m:1h")
+	now := int(time.Now().Unix())
+	now -= now % 60
+	for name, points := range map[string][]*whisper.TimeSeriesPoint{
+		"from.wsp": {{Time: now - 180, Value: 1}, {Time: now - 120, Value: 2}, {Time: now - 60, Value: 3}},
+		"to.wsp":   {{Time: now - 120, Value: 20}},
+	} {
+		file, err := whisper.Create(path.Join(dir, name), retentions, whisper.Average, 0.5)
+		if err != nil {
+			t.Fatalf("Failed to create %v: %v", name, err)
+		}
+		file.UpdateMany(points)
+		file.Close()
+	}
+
+	if err := FillWhisper(path.Join(dir, "from.wsp"), path.Join(dir, "to.wsp")); err != nil {
+		t.Fatalf("Failed to fill: %v", err)
+	}
+	_, archives, err := readWhisperPoints(path.Join(dir, "to.wsp"))
+	if err != nil {
+		t.Fatalf("Failed to read points: %v", err)
+	}
+	values := make(map[int]float64)
+	for _, point := range archives[0] {
+		values[point.Time] = point.Value
+	}
+	if values[now-180] != 1 || values[now-120] != 20 || values[now-60] != 3 {
+		t.Fatalf("Expecting only the gaps to be filled, received %v", values)
+	}
+}
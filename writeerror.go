@@ -0,0 +1,96 @@
+package silicon
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+/*
+	Identifies a group of points that could not be written; the first node
+	of their key and the kind of error.
+*/
+type WriteFailure struct {
+	Prefix string
+	Kind   string
+}
+
+// kinds of write failure
+const (
+	resolveFailure      = "resolve"        // no storage rules for the key
+	permissionFailure   = "permission"     // EACCES or EPERM
+	readOnlyFailure     = "read-only"      // EROFS
+	invalidPathFailure  = "invalid-path"   // the key does not map to a usable path
+	noSpaceFailure      = "no-space"       // ENOSPC or EDQUOT, transient
+	tooManyFilesFailure = "too-many-files" // EMFILE or ENFILE, transient
+	ioFailure           = "io"             // any other system error, transient
+	invalidFailure      = "invalid"        // rejected by whisper, eg. a corrupt file
+	timestampFailure    = "timestamp"      // outside the range Whisper can store
+)
+
+/*
+	An error writing a key's points, along with its kind.
+*/
+type writeError struct {
+	kind string
+	err  error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+/*
+	Classify err, which happened during action, by the system error it
+	wraps. Errors that do not come from the system are from whisper itself.
+*/
+func newWriteError(action string, err error) *writeError {
+	kind := invalidFailure
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EACCES, syscall.EPERM:
+			kind = permissionFailure
+		case syscall.EROFS:
+			kind = readOnlyFailure
+		case syscall.ENOTDIR, syscall.EISDIR, syscall.ENAMETOOLONG:
+			kind = invalidPathFailure
+		case syscall.ENOSPC, syscall.EDQUOT:
+			kind = noSpaceFailure
+		case syscall.EMFILE, syscall.ENFILE:
+			kind = tooManyFilesFailure
+		default:
+			kind = ioFailure
+		}
+	}
+	return &writeError{kind, errors.New(action + ": " + err.Error())}
+}
+
+func failureKind(err error) string {
+	if writeErr, ok := err.(*writeError); ok {
+		return writeErr.kind
+	}
+	return invalidFailure
+}
+
+/*
+	True if retrying might succeed; the disk may be freed up or files
+	closed.
+*/
+func isTransient(err error) bool {
+	switch failureKind(err) {
+	case noSpaceFailure, tooManyFilesFailure, ioFailure:
+		return true
+	}
+	return false
+}
+
+/*
+	The first node of the series name, used to group failures.
+*/
+func keyPrefix(key string) string {
+	if index := strings.IndexAny(key, ".;"); index >= 0 {
+		return key[:index]
+	}
+	return key
+}
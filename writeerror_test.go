@@ -0,0 +1,47 @@
+package silicon
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestNewWriteError(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		kind      string
+		transient bool
+	}{
+		{&os.PathError{Op: "open", Path: "foo.wsp", Err: syscall.EACCES}, permissionFailure, false},
+		{&os.PathError{Op: "open", Path: "foo.wsp", Err: syscall.EROFS}, readOnlyFailure, false},
+		{&os.PathError{Op: "mkdir", Path: "foo", Err: syscall.ENOTDIR}, invalidPathFailure, false},
+		{&os.PathError{Op: "write", Path: "foo.wsp", Err: syscall.ENOSPC}, noSpaceFailure, true},
+		{&os.PathError{Op: "open", Path: "foo.wsp", Err: syscall.EMFILE}, tooManyFilesFailure, true},
+		{&os.PathError{Op: "read", Path: "foo.wsp", Err: syscall.EIO}, ioFailure, true},
+		{fmt.Errorf("Invalid archive"), invalidFailure, false},
+	} {
+		err := newWriteError("Update error", test.err)
+		if kind := failureKind(err); kind != test.kind {
+			t.Errorf("Expecting %v to be %v, received %v", test.err, test.kind, kind)
+		}
+		if isTransient(err) != test.transient {
+			t.Errorf("Expecting %v transient to be %v", test.err, test.transient)
+		}
+	}
+	if failureKind(fmt.Errorf("unclassified")) != invalidFailure {
+		t.Errorf("Expecting unclassified errors to be invalid")
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	for key, expected := range map[string]string{
+		"foo.bar.baz":    "foo",
+		"foo":            "foo",
+		"foo;host=a.b.c": "foo",
+	} {
+		if prefix := keyPrefix(key); prefix != expected {
+			t.Errorf("Expecting %v prefix of %v, received %v", expected, key, prefix)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package silicon
+
+import (
+	"github.com/robyoung/go-cache"
+	"hash/fnv"
+	"sync"
+)
+
+/*
+	How the writer hands messages to the code that owns each key's file.
+	Messages for a key are always handled in the order they are dispatched.
+*/
+type writePool interface {
+	isOpen(key string) bool           // whether the key's file is known to be open
+	dispatch(message *storageMessage) // write the points or run the action for the key
+	close()                           // wait for every message and close every file
+}
+
+/*
+	Keeps up to maxOpen files open, each with its own goroutine. Opening a
+	file beyond that closes the least recently used, waiting for its
+	goroutine to finish writing.
+*/
+type filePool struct {
+	w     *writer
+	files *cache.LRUCache
+}
+
+func newFilePool(w *writer, maxOpen int) *filePool {
+	if maxOpen < 1 {
+		maxOpen = 1
+	}
+	pool := &filePool{w: w, files: cache.NewLRUCache(maxOpen)}
+	pool.files.SetEvictionHook(func(key string, value interface{}) {
+		metadata := value.(*writeMetadata)
+		close(metadata.in)
+		<-metadata.done
+	})
+
+	return pool
+}
+
+func (pool *filePool) isOpen(key string) bool {
+	value, _ := pool.files.Get(key)
+	return value != nil
+}
+
+func (pool *filePool) dispatch(message *storageMessage) {
+	if message.action != nil {
+		// deleting runs the eviction hook which closes the file
+		pool.files.Delete(message.key)
+		message.action()
+		return
+	}
+	value, _ := pool.files.Get(message.key)
+	var metadata *writeMetadata
+	if value != nil {
+		metadata = value.(*writeMetadata)
+	} else {
+		// the file is opened by run, which retries and reports failures
+		metadata = &writeMetadata{nil, make(chan *storageMessage), make(chan bool)}
+		pool.files.Set(message.key, metadata)
+		go pool.run(metadata)
+	}
+	metadata.in <- message
+}
+
+func (pool *filePool) run(metadata *writeMetadata) {
+	for message := range metadata.in {
+		pool.w.write(metadata, message)
+	}
+	if metadata.whisper != nil {
+		metadata.whisper.Close()
+	}
+	metadata.done <- true
+}
+
+func (pool *filePool) close() {
+	for _, key := range pool.files.Keys() {
+		// manually delete to cause the evictions to run
+		pool.files.Delete(key)
+	}
+}
+
+// messages that can wait for each worker before dispatch blocks
+const workerQueueLength = 64
+
+/*
+	A fixed number of workers each owning the keys hashed to it, along
+	with its share of the open files. Evicting a file closes it straight
+	away as its worker is the only one writing to it.
+*/
+type workerPool struct {
+	workers  []*writeWorker
+	running  sync.WaitGroup
+	openLock sync.RWMutex
+	open     map[string]bool // the keys whose files a worker has open
+}
+
+type writeWorker struct {
+	w       *writer
+	pool    *workerPool
+	in      chan *storageMessage
+	files   *cache.LRUCache
+	maxOpen int
+}
+
+/*
+	Create workers sharing maxOpen files between them. Each worker keeping
+	files open needs at least one, so there are no more workers than files.
+*/
+func newWorkerPool(w *writer, workers, maxOpen int) *workerPool {
+	if maxOpen > 0 && workers > maxOpen {
+		workers = maxOpen
+	}
+	pool := &workerPool{workers: make([]*writeWorker, workers), open: make(map[string]bool)}
+	pool.running.Add(workers)
+	for i := range pool.workers {
+		worker := &writeWorker{w: w, pool: pool, in: make(chan *storageMessage, workerQueueLength), maxOpen: shareLimit(maxOpen, workers, i)}
+		if worker.maxOpen > 0 {
+			worker.files = cache.NewLRUCache(worker.maxOpen)
+			worker.files.SetEvictionHook(func(key string, value interface{}) {
+				pool.setOpen(key, false)
+				value.(*writeMetadata).whisper.Close()
+			})
+		}
+		pool.workers[i] = worker
+		go func() {
+			defer pool.running.Done()
+			worker.run()
+		}()
+	}
+
+	return pool
+}
+
+/*
+	The share of limit for the i'th of n, the remainder going to the first
+	so that the shares add up to limit.
+*/
+func shareLimit(limit, n, i int) int {
+	if limit <= 0 {
+		return 0
+	}
+	share := limit / n
+	if i < limit%n {
+		share++
+	}
+	return share
+}
+
+func (pool *workerPool) isOpen(key string) bool {
+	pool.openLock.RLock()
+	defer pool.openLock.RUnlock()
+	return pool.open[key]
+}
+
+func (pool *workerPool) setOpen(key string, open bool) {
+	pool.openLock.Lock()
+	defer pool.openLock.Unlock()
+	if open {
+		pool.open[key] = true
+	} else {
+		delete(pool.open, key)
+	}
+}
+
+func (pool *workerPool) dispatch(message *storageMessage) {
+	hash := fnv.New32a()
+	hash.Write([]byte(message.key))
+	pool.workers[hash.Sum32()%uint32(len(pool.workers))].in <- message
+}
+
+func (pool *workerPool) close() {
+	for _, worker := range pool.workers {
+		close(worker.in)
+	}
+	pool.running.Wait()
+}
+
+func (worker *writeWorker) run() {
+	for message := range worker.in {
+		if message.action != nil {
+			if worker.files != nil {
+				worker.files.Delete(message.key)
+			}
+			message.action()
+			continue
+		}
+		metadata := &writeMetadata{}
+		if worker.files != nil {
+			if value, _ := worker.files.Get(message.key); value != nil {
+				metadata = value.(*writeMetadata)
+			}
+		}
+		opening := metadata.whisper == nil
+		worker.w.write(metadata, message)
+		if !opening || metadata.whisper == nil {
+			continue
+		}
+		if worker.files != nil {
+			worker.files.Set(message.key, metadata)
+			worker.pool.setOpen(message.key, true)
+		} else {
+			// no open files are kept, each set of points opens its own
+			metadata.whisper.Close()
+		}
+	}
+	if worker.files != nil {
+		for _, key := range worker.files.Keys() {
+			worker.files.Delete(key)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package silicon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriterWorkers(t *testing.T) {
+	for _, openFiles := range []int{0, 8} {
+		writer := NewWriter("/tmp/storage", new(failingResolver))
+		writer.SetWorkers(4)
+		writer.SetOpenFiles(openFiles)
+		var lock sync.Mutex
+		failed := make(map[string][]int)
+		writer.OnFailed(func(key string, count int, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			failed[key] = append(failed[key], count)
+		})
+		for i := 1; i <= 3; i++ {
+			for j := 0; j < 20; j++ {
+				writer.Send(fmt.Sprintf("foo.bar%v", j), makeGoodPoints(i, 1))
+			}
+		}
+		ran := false
+		writer.Exclusive("foo.bar1", func() error {
+			ran = true
+			return nil
+		})
+		writer.Close()
+
+		if !ran {
+			t.Fatalf("Expecting the exclusive action to run on its worker")
+		}
+		if len(failed) != 20 || !reflect.DeepEqual(failed["foo.bar7"], []int{1, 2, 3}) {
+			t.Fatalf("Expecting every key handled in order with %v open files, received %v", openFiles, failed)
+		}
+	}
+}
+
+func TestWorkerPoolSharesOpenFiles(t *testing.T) {
+	for _, test := range []struct {
+		workers, maxOpen int
+		expected         []int
+	}{
+		{4, 10, []int{3, 3, 2, 2}},
+		{8, 3, []int{1, 1, 1}},
+		{4, 0, []int{0, 0, 0, 0}},
+	} {
+		pool := newWorkerPool(NewWriter("/tmp/storage", new(dummyResolver)), test.workers, test.maxOpen)
+		shares := make([]int, len(pool.workers))
+		for i, worker := range pool.workers {
+			shares[i] = worker.maxOpen
+		}
+		pool.close()
+		if !reflect.DeepEqual(shares, test.expected) {
+			t.Errorf("Expecting %v workers to share %v files as %v, received %v", test.workers, test.maxOpen, test.expected, shares)
+		}
+	}
+}
+
+func TestWorkerPoolIsOpen(t *testing.T) {
+	path, _, resolver := setUpAndCheck(t)
+	defer tearDown(path)
+
+	pool := newWorkerPool(NewWriter(path, resolver), 2, 4)
+	pool.dispatch(&storageMessage{"foo.bar", makeGoodPoints(1, 1), nil})
+	for i := 0; i < 100 && !pool.isOpen("foo.bar"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !pool.isOpen("foo.bar") || pool.isOpen("foo.baz") {
+		t.Fatalf("Expecting only foo.bar to be open")
+	}
+	pool.close()
+	if pool.isOpen("foo.bar") {
+		t.Fatalf("Expecting files to be closed with the pool")
+	}
+}
+
+/*
+	Write one point to each of metrics existing files per iteration.
+*/
+func benchmarkWriterMetrics(b *testing.B, metrics int, configure func(*writer)) {
+	dir, _ := ioutil.TempDir("", "benchmark")
+	defer os.RemoveAll(dir)
+	resolver := new(dummyResolver)
+	keys := make([]string, metrics)
+	create := NewWriter(dir, resolver)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("foo.bar%v.baz", i)
+		create.Send(keys[i], makeGoodPoints(1, 1))
+	}
+	create.Close()
+
+	writer := NewWriter(dir, resolver)
+	configure(writer)
+	now := time.Now().Unix()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			writer.Send(key, []DataPoint{{float64(i), now - int64(i%300)}})
+		}
+	}
+	writer.Close()
+}
+
+func withOpenFiles(maxOpen int) func(*writer) {
+	return func(w *writer) {
+		w.SetOpenFiles(maxOpen)
+	}
+}
+
+func withWorkers(workers, maxOpen int) func(*writer) {
+	return func(w *writer) {
+		w.SetWorkers(workers)
+		w.SetOpenFiles(maxOpen)
+	}
+}
+
+func BenchmarkWriterFilePool100(b *testing.B)   { benchmarkWriterMetrics(b, 100, withOpenFiles(50)) }
+func BenchmarkWriterFilePool1000(b *testing.B)  { benchmarkWriterMetrics(b, 1000, withOpenFiles(50)) }
+func BenchmarkWriterFilePool10000(b *testing.B) { benchmarkWriterMetrics(b, 10000, withOpenFiles(50)) }
+func BenchmarkWriterLargeFilePool1000(b *testing.B) {
+	benchmarkWriterMetrics(b, 1000, withOpenFiles(2000))
+}
+func BenchmarkWriterLargeFilePool10000(b *testing.B) {
+	benchmarkWriterMetrics(b, 10000, withOpenFiles(2000))
+}
+func BenchmarkWriterWorkers100(b *testing.B)  { benchmarkWriterMetrics(b, 100, withWorkers(8, 2000)) }
+func BenchmarkWriterWorkers1000(b *testing.B) { benchmarkWriterMetrics(b, 1000, withWorkers(8, 2000)) }
+func BenchmarkWriterWorkers10000(b *testing.B) {
+	benchmarkWriterMetrics(b, 10000, withWorkers(8, 2000))
+}
+func BenchmarkWriterWorkersPerBatch1000(b *testing.B) {
+	benchmarkWriterMetrics(b, 1000, withWorkers(8, 0))
+}